@@ -1,9 +1,14 @@
 package main
 
+import "encoding/json"
+import "errors"
 import "fmt"
 import "net"
 import "bufio"
+import "crypto/tls"
+import "strings"
 import "time"
+import lockserver "github.com/dspezia/go.experiment/TechAwarness/lockserver"
 
 /*****************************************************************************/
 
@@ -12,12 +17,18 @@ var query2 = []byte(`{"Op":"set", "Target":"counter", "Arg":"0"}`)
 
 /*****************************************************************************/
 
-func clientLoop(result *chan int) {
+func clientLoop(result *chan int, config *tls.Config) {
 
 	res := 0
 	defer func() { *result <- res }()
 
-	conn, err := net.Dial("tcp", *flagTarget)
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial("tcp", *flagTarget, config)
+	} else {
+		conn, err = net.Dial("tcp", *flagTarget)
+	}
 	if err != nil {
 		fmt.Println("Error: ", err)
 		return
@@ -27,18 +38,39 @@ func clientLoop(result *chan int) {
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
 
+	// Select the protocol
+	q1, q2 := query1, query2
+	if *flagBinary {
+		writer.WriteByte(lockserver.BinaryMagic)
+		q1, _ = lockserver.AppendBinaryQuery(nil, &lockserver.MessageQuery{Op: "incr", Target: "counter", Arg: "1"})
+		q2, _ = lockserver.AppendBinaryQuery(nil, &lockserver.MessageQuery{Op: "set", Target: "counter", Arg: "0"})
+	}
+
+	// Authenticate the connection
+	if *flagUser != "" {
+		if err := authenticate(reader, writer); err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+	}
+
 	for i := 0; i < *flagNbIter; {
 
 		pos := 0
 		for ; i < *flagNbIter && pos < *flagPipe; pos += 2 {
-			writer.Write(query1)
-			writer.Write(query2)
+			writer.Write(q1)
+			writer.Write(q2)
 			i += 2
 		}
 		writer.Flush()
 
 		for j := 0; j < pos; j++ {
-			_, err := reader.ReadBytes('\n')
+			var err error
+			if *flagBinary {
+				_, err = lockserver.ReadBinaryReply(reader)
+			} else {
+				_, err = reader.ReadBytes('\n')
+			}
 			if err != nil {
 				break
 			}
@@ -50,13 +82,53 @@ func clientLoop(result *chan int) {
 
 /*****************************************************************************/
 
+// authenticate sends the credentials of the client, and waits for the reply
+func authenticate(reader *bufio.Reader, writer *bufio.Writer) error {
+
+	name, password, _ := strings.Cut(*flagUser, ":")
+	auth := &lockserver.MessageQuery{Op: "auth", Target: name, Arg: password}
+	reply := &lockserver.MessageReply{}
+	var err error
+	if *flagBinary {
+		buf, err := lockserver.AppendBinaryQuery(nil, auth)
+		if err != nil {
+			return err
+		}
+		writer.Write(buf)
+		writer.Flush()
+		reply, err = lockserver.ReadBinaryReply(reader)
+	} else {
+		json.NewEncoder(writer).Encode(auth)
+		writer.Flush()
+		var line []byte
+		if line, err = reader.ReadBytes('\n'); err == nil {
+			err = json.Unmarshal(line, reply)
+		}
+	}
+	if err == nil && reply.Status != "OK" {
+		err = errors.New(reply.Error)
+	}
+	return err
+}
+
+/*****************************************************************************/
+
 func mainClient() {
 
+	var config *tls.Config
+	if *flagTLS {
+		var err error
+		if config, err = lockserver.ClientTLSConfig(*flagCA, *flagCert, *flagKey); err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+	}
+
 	t := time.Now()
 
 	result := make(chan int)
 	for i := 0; i < *flagNbCon; i++ {
-		go clientLoop(&result)
+		go clientLoop(&result, config)
 	}
 	sum := 0
 	for i := 0; i < *flagNbCon; i++ {
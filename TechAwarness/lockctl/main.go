@@ -3,17 +3,41 @@ package main
 
 import "flag"
 import "fmt"
+import "strings"
+import "time"
 import lockserver "github.com/dspezia/go.experiment/TechAwarness/lockserver"
 
 /*****************************************************************************/
 
 var flagListen = flag.Bool("l", false, "Listen (server mode)")
 var flagServer = flag.String("s", ":4002", "(host:port)")
+var flagShards = flag.Int("shards", 1, "Number of core shards (server mode)")
+var flagResp = flag.String("resp", "", "Redis protocol listening address (host:port)")
+var flagAdmin = flag.String("admin", "", "Administration listening address (host:port)")
+var flagMonitor = flag.String("monitor", ":4010", "Monitoring and HTTP gateway listening address (host:port)")
+var flagVerbose = flag.Bool("v", false, "Log every query (server mode)")
+var flagAuth = flag.String("auth", "", "Credentials file (server mode)")
+var flagHash = flag.String("hash", "", "Print the hash of a password, for the credentials file")
+var flagCert = flag.String("cert", "", "Certificate file (server, or client with TLS)")
+var flagKey = flag.String("key", "", "Private key file of the certificate")
+var flagCA = flag.String("ca", "", "CA file verifying the peer (client certificates in server mode)")
+var flagSessionTTL = flag.Duration("ttl", 30*time.Second, "Default TTL of the HTTP sessions (server mode)")
+var flagDataDir = flag.String("d", "", "Persistence directory, or Raft state directory in cluster mode (server mode)")
+var flagSync = flag.String("sync", "periodic", "Fsync policy: always, periodic or never")
+var flagSnapshot = flag.Duration("snapshot", time.Minute, "Snapshot period")
+var flagReplication = flag.String("r", "", "Replication listening address (host:port)")
+var flagFollow = flag.String("f", "", "Follow a primary server (host:port)")
+var flagCluster = flag.String("cluster", "", "Raft addresses of the cluster nodes (host:port,host:port,...)")
+var flagNode = flag.Int("node", 0, "Index of this node in the cluster addresses")
+var flagShutdown = flag.Duration("shutdown", 10*time.Second, "Maximum time to close the connections at shutdown")
 
 var flagTarget = flag.String("t", "localhost:4002", "Target (host:port)")
 var flagNbCon = flag.Int("c", 50, "Number of connections")
 var flagNbIter = flag.Int("n", 10000, "Number of iterations")
 var flagPipe = flag.Int("p", 1, "Pipelining factor")
+var flagBinary = flag.Bool("b", false, "Use the binary protocol")
+var flagUser = flag.String("u", "", "Credentials of the client (user:password)")
+var flagTLS = flag.Bool("tls", false, "Connect with TLS")
 
 /*****************************************************************************/
 
@@ -21,9 +45,25 @@ func main() {
 
 	flag.Parse()
 
+	if *flagHash != "" {
+		h, err := lockserver.HashPassword(*flagHash)
+		if err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+		fmt.Println(h)
+		return
+	}
 	if *flagListen {
 		fmt.Println("Server starting ...")
-		lockserver.MainServer(*flagServer)
+		opts, err := serverOptions()
+		if err != nil {
+			fmt.Println("Error: ", err)
+			return
+		}
+		if err := lockserver.MainServer(opts); err != nil {
+			fmt.Println("Error: ", err)
+		}
 	} else {
 		fmt.Println("Client starting ...")
 		mainClient()
@@ -31,3 +71,41 @@ func main() {
 }
 
 /*****************************************************************************/
+
+// serverOptions builds the server configuration from the command line
+func serverOptions() (*lockserver.Options, error) {
+
+	opts := lockserver.DefaultOptions()
+	opts.Addr = *flagServer
+	opts.Shards = *flagShards
+	opts.RespAddr = *flagResp
+	opts.AdminAddr = *flagAdmin
+	opts.MonitorAddr = *flagMonitor
+	opts.Verbose = *flagVerbose
+	opts.AuthFile = *flagAuth
+	opts.TLSCert = *flagCert
+	opts.TLSKey = *flagKey
+	opts.TLSClientCA = *flagCA
+	opts.SessionTTL = *flagSessionTTL
+	opts.DataDir = *flagDataDir
+	opts.SnapshotInterval = *flagSnapshot
+	opts.ReplicationAddr = *flagReplication
+	opts.Follow = *flagFollow
+	opts.ShutdownTimeout = *flagShutdown
+	if *flagCluster != "" {
+		opts.ClusterPeers = strings.Split(*flagCluster, ",")
+		if *flagNode < 0 || *flagNode >= len(opts.ClusterPeers) {
+			return nil, fmt.Errorf("invalid node index %d", *flagNode)
+		}
+		opts.ClusterID = *flagNode
+	}
+
+	policy, ok := lockserver.SyncPolicies[*flagSync]
+	if !ok {
+		return nil, fmt.Errorf("invalid fsync policy %q", *flagSync)
+	}
+	opts.Sync = policy
+	return opts, nil
+}
+
+/*****************************************************************************/
@@ -0,0 +1,146 @@
+// This file contains the administration operations, used by the operators to
+// recover from misbehaving clients without restarting the server. They are
+// only accepted on the administration listener.
+
+package lockserver
+
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+/*****************************************************************************/
+
+// adminOps lists the operations restricted to the administration listener
+var adminOps = map[Operation]bool{
+	OP_CLIENTS: true,
+	OP_RELEASE: true,
+	OP_KILL:    true,
+	OP_PROMOTE: true,
+}
+
+/*****************************************************************************/
+
+// ClientInfo describes a client connection, in the reply of the clients
+// operation
+type ClientInfo struct {
+	Id       uint64    // Connection id, given to the kill operation
+	Addr     string    // Remote address
+	Name     string    `json:",omitempty"` // Name given with the hello operation
+	Since    time.Time // Connection time
+	Commands int64     // Number of queries received
+	Locks    []string  `json:",omitempty"` // Held locks
+}
+
+/*****************************************************************************/
+
+// Connection is implemented by the clients bound to a network connection,
+// which can be listed and disconnected by the administration operations
+type Connection interface {
+	Replier
+	Info() *ClientInfo // Description of the connection, nil if not connected
+	Kill()             // Closes the connection
+}
+
+/*****************************************************************************/
+
+// connections returns the connected clients known by the core, by id
+func (core *Core) connections() []Connection {
+
+	res := []Connection{}
+	for _, clt := range core.locks.Clients() {
+		if conn, ok := clt.(Connection); ok && conn.Info() != nil {
+			res = append(res, conn)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Info().Id < res[j].Info().Id })
+	return res
+}
+
+/*****************************************************************************/
+
+// handleClients lists the connected clients, with the locks they hold
+func (core *Core) handleClients(query *MessageQuery) {
+
+	infos := []ClientInfo{}
+	for _, conn := range core.connections() {
+		info := conn.Info()
+		info.Name = core.names[conn]
+		for _, it := range core.locks.Intents(conn) {
+			if it.held() {
+				info.Locks = append(info.Locks, it.name)
+			}
+		}
+		infos = append(infos, *info)
+	}
+	query.reply(&MessageReply{Status: "OK", Clients: infos})
+}
+
+/*****************************************************************************/
+
+// handleRelease forcibly releases a lock, and grants it to the next waiters.
+// The holders are notified with a revoked event; a pending multi-lock request
+// holding the lock is cancelled. The former holders are returned.
+func (core *Core) handleRelease(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Releasing", query.Target)
+	}
+
+	// Collect the holders first: the lock is granted to the waiters as soon
+	// as they are removed
+	holders := []*Intent{}
+	for _, it := range core.locks.Queue(query.Target) {
+		if it.granted {
+			holders = append(holders, it)
+		}
+	}
+	if len(holders) == 0 {
+		query.reply(&MessageReply{Status: "KO", Error: "Cannot find this lock"})
+		return
+	}
+
+	var granted []*Intent
+	names := []string{}
+	for _, it := range holders {
+		names = append(names, core.name(it.clt))
+		if g := it.group; g != nil && !it.held() {
+			res, _ := core.locks.CancelGroup(g)
+			granted = append(granted, res...)
+			it.clt.Reply(&MessageReply{Id: g.id, Status: "KO", Error: "Lock revoked"})
+			continue
+		}
+		res, _ := core.locks.Remove(it.clt, it.name)
+		granted = append(granted, res...)
+		it.clt.Reply(&MessageReply{Status: "OK", Event: "revoked", Target: it.name, Value: it.fencingToken()})
+	}
+	query.reply(&MessageReply{Status: "OK", Value: strings.Join(names, ",")})
+	core.grant(granted)
+}
+
+/*****************************************************************************/
+
+// handleKill closes the connection of a client, given by its id in the
+// argument. The client is then removed as for a normal disconnection.
+func (core *Core) handleKill(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Killing", query.Arg)
+	}
+
+	id, err := strconv.ParseUint(query.Arg, 10, 64)
+	if err != nil {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid client id"})
+		return
+	}
+	for _, conn := range core.connections() {
+		if conn.Info().Id == id {
+			conn.Kill()
+			query.reply(&MessageReply{Status: "OK"})
+			return
+		}
+	}
+	query.reply(&MessageReply{Status: "KO", Error: "Cannot find this client"})
+}
+
+/*****************************************************************************/
@@ -0,0 +1,128 @@
+package lockserver
+
+import "io"
+import "strconv"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func TestAdmin(t *testing.T) {
+
+	router := startShards(2)
+	enc0, next0, _ := pipeClient(t, router)
+	enc1, next1, con1 := pipeClient(t, router)
+	enca, nexta, _ := pipeConnect(t, router, true)
+
+	// The administration operations are restricted
+	enc0.Encode(&MessageQuery{Op: "clients"})
+	if m := next0(); m.Status != "KO" || m.Error != "Permission denied" {
+		t.Fatal("Wrong reply", m)
+	}
+
+	enc0.Encode(&MessageQuery{Op: "hello", Arg: "job-0"})
+	enc0.Encode(&MessageQuery{Op: "lock", Target: "toto"})
+	enc0.Encode(&MessageQuery{Op: "lock", Target: "titi"})
+	for i := 0; i < 3; i++ {
+		if m := next0(); m.Status != "OK" {
+			t.Fatal("Wrong reply", m)
+		}
+	}
+	enc1.Encode(&MessageQuery{Id: "1", Op: "lock", Target: "toto"})
+
+	// List the clients, with the locks they hold on all the shards
+	enca.Encode(&MessageQuery{Op: "clients"})
+	m := nexta()
+	if m.Status != "OK" || len(m.Clients) != 3 {
+		t.Fatal("Wrong clients reply", m)
+	}
+	if c := m.Clients[0]; c.Name != "job-0" || c.Commands != 4 || len(c.Locks) != 2 || c.Since.IsZero() || c.Addr == "" {
+		t.Error("Wrong client", c)
+	}
+	if c := m.Clients[1]; c.Id <= m.Clients[0].Id || len(c.Locks) != 0 {
+		t.Error("Wrong client", c)
+	}
+	id := strconv.FormatUint(m.Clients[1].Id, 10)
+
+	// Force the release of a lock: the holder is notified, and the waiter
+	// gets the lock
+	enca.Encode(&MessageQuery{Op: "release", Target: "toto"})
+	if m := nexta(); m.Status != "OK" || m.Value != "job-0" {
+		t.Error("Wrong release reply", m)
+	}
+	if m := next0(); m.Event != "revoked" || m.Target != "toto" || m.Value == "" {
+		t.Error("Wrong notification", m)
+	}
+	if m := next1(); m.Status != "OK" || m.Id != "1" {
+		t.Error("Wrong grant", m)
+	}
+	enca.Encode(&MessageQuery{Op: "release", Target: "tutu"})
+	if m := nexta(); m.Status != "KO" {
+		t.Error("Wrong release reply", m)
+	}
+
+	// Kill the connection of the new holder: the lock is released
+	enca.Encode(&MessageQuery{Op: "kill", Arg: "x"})
+	enca.Encode(&MessageQuery{Op: "kill", Arg: "999"})
+	enca.Encode(&MessageQuery{Op: "kill", Arg: id})
+	for _, status := range []string{"KO", "KO", "OK"} {
+		if m := nexta(); m.Status != status {
+			t.Error("Wrong kill reply", m)
+		}
+	}
+	con1.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := con1.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Connection not closed", err)
+	}
+	for i := 0; ; i++ {
+		enca.Encode(&MessageQuery{Op: "owner", Target: "toto"})
+		if m := nexta(); m.Value == "" {
+			break
+		} else if i == 100 {
+			t.Fatal("Lock not released", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*****************************************************************************/
+
+func TestRelease(t *testing.T) {
+
+	core := startCore()
+	c0, c1, c2, c3 := newReplier(core), newReplier(core), newReplier(core), newReplier(core)
+	admin := func(op string, target string) {
+		core.in <- &MessageQuery{Op: op, Target: target, oper: Service[op], clt: c3, admin: true}
+	}
+
+	// Shared holders, and an exclusive waiter
+	c0.sendMode("lock", "toto", "shared")
+	c0.expect(t, "OK")
+	c1.sendMode("lock", "toto", "shared")
+	c1.expect(t, "OK")
+	c2.send("lock", "toto", "")
+
+	admin("release", "toto")
+	if m := c3.expect(t, "OK"); m.Value != describe(c0)+","+describe(c1) {
+		t.Error("Wrong release reply", m)
+	}
+	c0.expect(t, "OK")
+	c1.expect(t, "OK")
+	c2.expect(t, "OK")
+
+	// A pending multi-lock request holding the lock is cancelled
+	c0.send("lock", "titi", "")
+	c0.expect(t, "OK")
+	core.in <- &MessageQuery{Op: "lockall", Targets: []string{"tata", "titi"}, oper: OP_LOCKALL, clt: c1}
+	admin("release", "tata")
+	c3.expect(t, "OK")
+	if m := c1.expect(t, "KO"); m.Error != "Lock revoked" {
+		t.Error("Wrong reply", m)
+	}
+	admin("owner", "titi")
+	if m := c3.expect(t, "OK"); len(m.Info) != 1 {
+		t.Error("Multi-lock request not cancelled", m)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,211 @@
+// This file contains the authentication of the clients, and the access
+// control lists. The users are loaded from a JSON credentials file:
+//
+//   {"Users": [
+//     {"Name": "admin", "Password": "<bcrypt hash>", "Rules": [{}]},
+//     {"Name": "stats", "Password": "<bcrypt hash>",
+//      "Rules": [{"Ops": ["get", "watch"], "Prefix": "stats."}]}
+//   ]}
+//
+// The password hashes are given by lockctl -hash. They are salted, and include
+// their cost.
+//
+// A query is allowed if one of the rules of the user lists its operation (an
+// empty list allows all of them), and all its target names start with the
+// prefix of the rule.
+
+package lockserver
+
+import "code.google.com/p/go.crypto/bcrypt"
+import "encoding/json"
+import "fmt"
+import "os"
+import "strings"
+import "sync/atomic"
+
+/*****************************************************************************/
+
+// untargeted lists the operations which do not concern a named lock or value.
+// Only their operation is checked against the rules.
+var untargeted = map[Operation]bool{
+	OP_HELLO:   true,
+	OP_LOCKS:   true,
+	OP_CLIENTS: true,
+	OP_KILL:    true,
+}
+
+/*****************************************************************************/
+
+// Credentials is the content of the credentials file
+type Credentials struct {
+	Users []*User
+}
+
+// User is an account allowed to connect to the server
+type User struct {
+	Name     string
+	Password string // Bcrypt hash of the password, empty if disabled
+	Rules    []*Rule
+}
+
+// Rule gives access to some operations on the names starting with a prefix
+type Rule struct {
+	Ops    []string `json:",omitempty"` // Allowed operations, all of them if empty
+	Prefix string   `json:",omitempty"` // Prefix of the allowed names
+	ops    map[Operation]bool
+}
+
+/*****************************************************************************/
+
+// Auth checks the credentials and the rights of the clients
+type Auth struct {
+	users   map[string]*User // Users, by name
+	denials int64            // Number of denied queries
+}
+
+/*****************************************************************************/
+
+// HashPassword returns the hash of a password, as stored in the credentials
+// file. A new salt is drawn for each call.
+func HashPassword(password string) (string, error) {
+
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+/*****************************************************************************/
+
+// LoadAuth reads a credentials file
+func LoadAuth(path string) (*Auth, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cred Credentials
+	if err := json.Unmarshal(data, &cred); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return NewAuth(&cred)
+}
+
+/*****************************************************************************/
+
+// NewAuth builds an Auth object from some credentials, checking the rules
+func NewAuth(cred *Credentials) (*Auth, error) {
+
+	a := &Auth{users: make(map[string]*User)}
+	for _, u := range cred.Users {
+		// An empty password is only for the users with a client certificate
+		if _, err := bcrypt.Cost([]byte(u.Password)); u.Password != "" && err != nil {
+			return nil, fmt.Errorf("invalid password hash for user %q", u.Name)
+		}
+		for _, r := range u.Rules {
+			r.ops = make(map[Operation]bool)
+			for _, op := range r.Ops {
+				oper, ok := Service[op]
+				if !ok {
+					return nil, fmt.Errorf("unknown operation %q for user %q", op, u.Name)
+				}
+				r.ops[oper] = true
+			}
+		}
+		a.users[u.Name] = u
+	}
+	return a, nil
+}
+
+/*****************************************************************************/
+
+// Login returns the user matching some credentials, or nil
+func (a *Auth) Login(name string, password string) *User {
+
+	u, ok := a.users[name]
+	if !ok {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil
+	}
+	return u
+}
+
+/*****************************************************************************/
+
+// Denials returns the number of denied queries
+func (a *Auth) Denials() int64 {
+	return atomic.LoadInt64(&a.denials)
+}
+
+/*****************************************************************************/
+
+// authorize checks a query of a connection, whose user is set by the auth
+// operation. It returns the reply of the auth operation and of the denied
+// queries, or nil if the query can be processed.
+func (a *Auth) authorize(user **User, m *MessageQuery) *MessageReply {
+
+	switch {
+	case m.oper == OP_AUTH:
+		// The user name is given as target, the password as argument
+		u := a.Login(m.Target, m.Arg)
+		if u == nil {
+			return a.deny("Invalid credentials")
+		}
+		*user = u
+		return &MessageReply{Status: "OK"}
+	case *user == nil:
+		return a.deny("Authentication required")
+	case !(*user).allows(m):
+		return a.deny("Permission denied")
+	}
+	return nil
+}
+
+/*****************************************************************************/
+
+// deny counts a denied query, and returns its reply
+func (a *Auth) deny(msg string) *MessageReply {
+
+	atomic.AddInt64(&a.denials, 1)
+	return &MessageReply{Status: "KO", Error: msg}
+}
+
+/*****************************************************************************/
+
+// allows returns true if one of the rules of the user allows a query
+func (u *User) allows(m *MessageQuery) bool {
+
+	for _, r := range u.Rules {
+		if r.allows(m) {
+			return true
+		}
+	}
+	return false
+}
+
+/*****************************************************************************/
+
+// allows returns true if the rule allows a query
+func (r *Rule) allows(m *MessageQuery) bool {
+
+	if len(r.ops) > 0 && !r.ops[m.oper] {
+		return false
+	}
+	if untargeted[m.oper] {
+		return true
+	}
+	if len(m.Targets) == 0 {
+		return strings.HasPrefix(m.Target, r.Prefix)
+	}
+	for _, name := range m.Targets {
+		if !strings.HasPrefix(name, r.Prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+/*****************************************************************************/
@@ -0,0 +1,168 @@
+package lockserver
+
+import "code.google.com/p/go.crypto/bcrypt"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// testHash hashes a password with the minimum cost, to keep the tests fast
+func testHash(t *testing.T, password string) string {
+
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+// testAuth builds the credentials of the tests: an administrator, and a user
+// with a read-only access to the stats values
+func testAuth(t *testing.T) *Auth {
+
+	auth, err := NewAuth(&Credentials{Users: []*User{
+		{Name: "admin", Password: testHash(t, "secret"), Rules: []*Rule{{}}},
+		{Name: "stats", Password: testHash(t, "pass"), Rules: []*Rule{
+			{Ops: []string{"get", "watch", "hello"}, Prefix: "stats."},
+			{Ops: []string{"lock", "lockall", "unlock"}, Prefix: "job."},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+/*****************************************************************************/
+
+func TestHashPassword(t *testing.T) {
+
+	// The hashes are salted, and keep their cost
+	h1, err1 := HashPassword("secret")
+	h2, err2 := HashPassword("secret")
+	if err1 != nil || err2 != nil || h1 == h2 {
+		t.Fatal("Wrong hashes", h1, h2, err1, err2)
+	}
+	if cost, err := bcrypt.Cost([]byte(h1)); err != nil || cost != bcrypt.DefaultCost {
+		t.Error("Wrong cost", cost, err)
+	}
+	auth, err := NewAuth(&Credentials{Users: []*User{{Name: "admin", Password: h1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Login("admin", "secret") == nil || auth.Login("admin", "Secret") != nil {
+		t.Error("Wrong login")
+	}
+}
+
+/*****************************************************************************/
+
+func TestAuthRules(t *testing.T) {
+
+	auth := testAuth(t)
+	if auth.Login("stats", "secret") != nil || auth.Login("nobody", "secret") != nil {
+		t.Error("Invalid credentials accepted")
+	}
+	admin, user := auth.Login("admin", "secret"), auth.Login("stats", "pass")
+	if admin == nil || user == nil {
+		t.Fatal("Valid credentials rejected")
+	}
+
+	for _, c := range []struct {
+		m       MessageQuery
+		allowed bool
+	}{
+		{MessageQuery{Op: "get", Target: "stats.cpu"}, true},
+		{MessageQuery{Op: "set", Target: "stats.cpu"}, false},
+		{MessageQuery{Op: "get", Target: "other"}, false},
+		{MessageQuery{Op: "hello"}, true},
+		{MessageQuery{Op: "locks"}, false},
+		{MessageQuery{Op: "lockall", Targets: []string{"job.1", "job.2"}}, true},
+		{MessageQuery{Op: "lockall", Targets: []string{"job.1", "stats.cpu"}}, false},
+	} {
+		c.m.oper = Service[c.m.Op]
+		if user.allows(&c.m) != c.allowed {
+			t.Errorf("Wrong rights for %+v", c.m)
+		}
+		if !admin.allows(&c.m) {
+			t.Errorf("Administrator denied for %+v", c.m)
+		}
+	}
+
+	if _, err := NewAuth(&Credentials{Users: []*User{{Name: "x", Password: "abc"}}}); err == nil {
+		t.Error("Invalid hash accepted")
+	}
+	if auth.Login("admin", "") != nil || auth.Login("admin", "secret2") != nil {
+		t.Error("Wrong password accepted")
+	}
+	if _, err := NewAuth(&Credentials{Users: []*User{{Name: "x", Password: testHash(t, ""), Rules: []*Rule{{Ops: []string{"foo"}}}}}}); err == nil {
+		t.Error("Unknown operation accepted")
+	}
+}
+
+/*****************************************************************************/
+
+func TestAuth(t *testing.T) {
+
+	router := startShards(1)
+	router.auth = testAuth(t)
+	enc, next, _ := pipeClient(t, router)
+
+	for _, c := range []struct {
+		m     MessageQuery
+		error string
+	}{
+		{MessageQuery{Op: "get", Target: "stats.cpu"}, "Authentication required"},
+		{MessageQuery{Op: "auth", Target: "stats", Arg: "secret"}, "Invalid credentials"},
+		{MessageQuery{Op: "auth", Target: "stats", Arg: "pass"}, ""},
+		{MessageQuery{Op: "get", Target: "stats.cpu"}, ""},
+		{MessageQuery{Op: "set", Target: "stats.cpu", Arg: "1"}, "Permission denied"},
+		{MessageQuery{Op: "lock", Target: "job.1"}, ""},
+		{MessageQuery{Op: "get", Target: "job.1"}, "Permission denied"},
+	} {
+		enc.Encode(&c.m)
+		if m := next(); m.Error != c.error {
+			t.Errorf("%+v: expected %q, got %+v", c.m, c.error, m)
+		}
+	}
+	if n := router.denials(); n != 4 {
+		t.Error("Wrong number of denials", n)
+	}
+}
+
+/*****************************************************************************/
+
+func TestGatewayAuth(t *testing.T) {
+
+	router := startShards(1)
+	router.auth = testAuth(t)
+	mux := http.NewServeMux()
+	NewGateway(router, time.Hour).register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method string, path string, user string, password string, code int) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("%s %s: expected %d, got %d", method, path, code, resp.StatusCode)
+		}
+	}
+	request("GET", "/counters/stats.cpu", "", "", 401)
+	request("GET", "/counters/stats.cpu", "stats", "secret", 401)
+	request("GET", "/counters/stats.cpu", "stats", "pass", 200)
+	request("PUT", "/counters/stats.cpu", "stats", "pass", 403)
+	request("GET", "/counters/stats.cpu", "admin", "secret", 200)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,403 @@
+// This file contains the binary protocol, a compact alternative to JSON. A
+// client selects it by sending the BinaryMagic byte right after connecting.
+// Each message is then a frame: the length of its body as an unsigned varint,
+// followed by the body.
+//
+// Query body:  op (1 byte), flags (1 byte), id, target, [arg], [lease], [targets]
+// Reply body:  status (1 byte), id, value, [error if KO], [target if notification]
+//
+// The reply status is 0 for OK, 1 for KO, 2 for a "change" notification, and
+// 3 for a "revoked" notification. The Info of the replies is not transmitted.
+//
+// Strings are prefixed by their length as an unsigned varint. The arg is a
+// string for the hello and auth operations, otherwise a signed varint: a
+// number of milliseconds for the lock, lockall and renew operations, a plain
+// integer otherwise. The lease is an unsigned varint
+// number of milliseconds, and the targets a count followed by the strings.
+
+package lockserver
+
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "io"
+import "strconv"
+import "sync/atomic"
+import "time"
+
+/*****************************************************************************/
+
+// BinaryMagic is the first byte sent by the clients of the binary protocol
+const BinaryMagic = 0xB1
+
+const maxFrame = 64 * 1024 // Maximum size of a frame body
+
+// Flags of a query frame, giving the optional fields
+const (
+	BIN_SHARED = 1 << iota
+	BIN_ARG
+	BIN_LEASE
+	BIN_TARGETS
+	BIN_PREFIX
+)
+
+// Status of a reply frame
+const (
+	BIN_OK = iota
+	BIN_KO
+	BIN_CHANGE
+	BIN_REVOKED
+)
+
+// binaryOps lists the operations, indexed by their binary code
+var binaryOps = []string{"", "lock", "unlock", "get", "set", "incr", "trylock", "renew", "check", "lockall", "promote", "watch", "unwatch", "hello", "owner", "locks", "auth"}
+
+// durationArgs lists the operations whose argument is a duration
+var durationArgs = map[string]bool{"lock": true, "lockall": true, "renew": true}
+
+// stringArgs lists the operations whose argument is a string
+var stringArgs = map[string]bool{"hello": true, "auth": true}
+
+var errFrame = errors.New("Invalid frame")
+
+/*****************************************************************************/
+
+// AppendBinaryQuery appends the frame of a query to a buffer
+func AppendBinaryQuery(buf []byte, m *MessageQuery) ([]byte, error) {
+
+	code := -1
+	for i, op := range binaryOps {
+		if op == m.Op {
+			code = i
+		}
+	}
+	if code <= 0 {
+		return buf, errors.New("Unknown operation")
+	}
+
+	// Encode the optional fields first, to compute the flags
+	flags := byte(0)
+	var opt []byte
+	if m.Mode == "prefix" {
+		flags |= BIN_PREFIX
+	} else if shared, ok := parseMode(m.Mode); !ok {
+		return buf, errors.New("Invalid mode")
+	} else if shared {
+		flags |= BIN_SHARED
+	}
+	if m.Arg != "" && stringArgs[m.Op] {
+		flags |= BIN_ARG
+		opt = appendString(opt, m.Arg)
+	} else if m.Arg != "" {
+		n, err := binaryArg(m.Op, m.Arg)
+		if err != nil {
+			return buf, err
+		}
+		flags |= BIN_ARG
+		opt = binary.AppendVarint(opt, n)
+	}
+	if m.Lease != "" {
+		d, err := time.ParseDuration(m.Lease)
+		if err != nil || d < 0 {
+			return buf, errors.New("Invalid lease")
+		}
+		flags |= BIN_LEASE
+		opt = binary.AppendUvarint(opt, uint64(d/time.Millisecond))
+	}
+	if len(m.Targets) > 0 {
+		flags |= BIN_TARGETS
+		opt = binary.AppendUvarint(opt, uint64(len(m.Targets)))
+		for _, t := range m.Targets {
+			opt = appendString(opt, t)
+		}
+	}
+
+	body := []byte{byte(code), flags}
+	body = appendString(body, m.Id)
+	body = appendString(body, m.Target)
+	body = append(body, opt...)
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	return append(buf, body...), nil
+}
+
+/*****************************************************************************/
+
+// binaryArg converts the argument of a query into a number
+func binaryArg(op string, arg string) (int64, error) {
+
+	if durationArgs[op] {
+		d, err := time.ParseDuration(arg)
+		return int64(d / time.Millisecond), err
+	}
+	return strconv.ParseInt(arg, 10, 64)
+}
+
+/*****************************************************************************/
+
+// parseBinaryQuery decodes the body of a query frame
+func parseBinaryQuery(body []byte) (*MessageQuery, error) {
+
+	d := &decoder{b: body}
+	code, flags := int(d.byte()), d.byte()
+	m := &MessageQuery{Id: d.string(), Target: d.string()}
+	if code < len(binaryOps) {
+		m.Op = binaryOps[code]
+	}
+	if flags&BIN_SHARED != 0 {
+		m.Mode = "shared"
+	} else if flags&BIN_PREFIX != 0 {
+		m.Mode = "prefix"
+	}
+	if flags&BIN_ARG != 0 && stringArgs[m.Op] {
+		m.Arg = d.string()
+	} else if flags&BIN_ARG != 0 {
+		n := d.varint()
+		if durationArgs[m.Op] {
+			m.Arg = strconv.FormatInt(n, 10) + "ms"
+		} else {
+			m.Arg = strconv.FormatInt(n, 10)
+		}
+	}
+	if flags&BIN_LEASE != 0 {
+		m.Lease = strconv.FormatUint(d.uvarint(), 10) + "ms"
+	}
+	if flags&BIN_TARGETS != 0 {
+		n := d.uvarint()
+		if n > uint64(len(body)) {
+			return nil, errFrame
+		}
+		for i := uint64(0); i < n; i++ {
+			m.Targets = append(m.Targets, d.string())
+		}
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return nil, errFrame
+	}
+	return m, nil
+}
+
+/*****************************************************************************/
+
+// appendBinaryReply appends the frame of a reply to a buffer
+func appendBinaryReply(buf []byte, r *MessageReply) []byte {
+
+	body := make([]byte, 1, 32)
+	switch {
+	case r.Status != "OK":
+		body[0] = BIN_KO
+	case r.Event == "change":
+		body[0] = BIN_CHANGE
+	case r.Event == "revoked":
+		body[0] = BIN_REVOKED
+	}
+	body = appendString(body, r.Id)
+	body = appendString(body, r.Value)
+	switch body[0] {
+	case BIN_KO:
+		body = appendString(body, r.Error)
+	case BIN_CHANGE, BIN_REVOKED:
+		body = appendString(body, r.Target)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	return append(buf, body...)
+}
+
+/*****************************************************************************/
+
+// ReadBinaryReply reads and decodes a reply frame
+func ReadBinaryReply(reader *bufio.Reader) (*MessageReply, error) {
+
+	body, err := readFrame(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{b: body}
+	r := &MessageReply{Status: "OK"}
+	status := d.byte()
+	r.Id, r.Value = d.string(), d.string()
+	switch status {
+	case BIN_KO:
+		r.Status, r.Error = "KO", d.string()
+	case BIN_CHANGE:
+		r.Event, r.Target = "change", d.string()
+	case BIN_REVOKED:
+		r.Event, r.Target = "revoked", d.string()
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return nil, errFrame
+	}
+	return r, nil
+}
+
+/*****************************************************************************/
+
+// readFrame reads the body of a frame, reusing a buffer if possible
+func readFrame(reader *bufio.Reader, buf []byte) ([]byte, error) {
+
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrame {
+		return nil, errFrame
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+/*****************************************************************************/
+
+// appendString appends a length-prefixed string to a buffer
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+/*****************************************************************************/
+
+// decoder reads the fields of a frame body. The first error is kept, and the
+// next reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+
+	if d.err != nil || len(d.b) == 0 {
+		d.err = errFrame
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) uvarint() uint64 {
+
+	n, k := binary.Uvarint(d.b)
+	if d.err != nil || k <= 0 {
+		d.err = errFrame
+		return 0
+	}
+	d.b = d.b[k:]
+	return n
+}
+
+func (d *decoder) varint() int64 {
+
+	n, k := binary.Varint(d.b)
+	if d.err != nil || k <= 0 {
+		d.err = errFrame
+		return 0
+	}
+	d.b = d.b[k:]
+	return n
+}
+
+func (d *decoder) string() string {
+
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.b)) {
+		d.err = errFrame
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+/*****************************************************************************/
+
+// binIn processes incoming binary frames from the client socket, decode
+// them, and send messages to the core shards.
+func (clt *Client) binIn() {
+
+	// Be sure the shards are notified when connection is closed
+	defer clt.router.broadcast(&MessageQuery{clt: clt, oper: OP_CLOSE})
+	clt.router.broadcast(&MessageQuery{clt: clt, oper: OP_OPEN})
+
+	// The queries are numbered when they are processed by several shards,
+	// or answered without the core
+	ordered := len(clt.router.shards) > 1 || clt.router.auth != nil
+	seq := uint64(0)
+
+	var buf []byte
+	for {
+		// Read an incoming frame and decode it
+		body, err := readFrame(clt.reader, buf)
+		if err == io.EOF || atomic.LoadInt32(&clt.draining) != 0 {
+			break
+		}
+		var m *MessageQuery
+		if err == nil {
+			buf = body
+			m, err = parseBinaryQuery(body)
+		}
+		if ordered {
+			seq++
+		}
+		if err != nil {
+			// Decoding error: notify the core, close the connection
+			clt.router.shards[0].in <- &MessageQuery{clt: clt, oper: OP_NONE, seq: seq}
+			break
+		}
+
+		// Convert operation code and forward to the shard of the target
+		atomic.AddInt64(&clt.commands, 1)
+		m.clt, m.seq, m.admin = clt, seq, clt.admin
+		m.oper = Service[m.Op]
+		if auth := clt.router.auth; auth != nil {
+			if reply := auth.authorize(&clt.user, m); reply != nil {
+				m.reply(reply)
+				continue
+			}
+		}
+		clt.router.route(m)
+	}
+}
+
+/*****************************************************************************/
+
+// binOut is waiting for outgoing traffic from the core, encode it in binary
+// frames, and write them to the client socket. The socket is flushed when no
+// other reply is pending.
+func (clt *Client) binOut() {
+
+	// Be sure the connection is closed in the end
+	defer clt.router.untrack(clt)
+	defer clt.con.Close()
+
+	writer := bufio.NewWriter(clt.con)
+	var buf []byte
+	end := false
+	clt.router.deliver(clt.coreOut, func(reply *MessageReply) {
+		// Ignore all messages after a write error
+		if end {
+			return
+		}
+		buf = appendBinaryReply(buf[:0], reply)
+		clt.router.deadline(clt.con)
+		if _, err := writer.Write(buf); err != nil {
+			clt.router.writeFailed(clt, &clt.slow, err)
+			end = true
+		}
+	}, func() {
+		if !end && writer.Buffered() > 0 {
+			clt.router.deadline(clt.con)
+			if err := writer.Flush(); err != nil {
+				clt.router.writeFailed(clt, &clt.slow, err)
+				end = true
+			}
+		}
+	})
+	writer.Flush()
+}
+
+/*****************************************************************************/
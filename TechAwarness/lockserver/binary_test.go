@@ -0,0 +1,153 @@
+package lockserver
+
+import "bufio"
+import "encoding/json"
+import "net"
+import "reflect"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func TestBinaryQuery(t *testing.T) {
+
+	queries := []*MessageQuery{
+		{Op: "get", Target: "toto"},
+		{Id: "12", Op: "set", Target: "toto", Arg: "-5"},
+		{Op: "lock", Target: "toto", Arg: "500ms", Mode: "shared", Lease: "2s"},
+		{Op: "lockall", Targets: []string{"a", "b"}},
+		{Op: "watch", Target: "to", Mode: "prefix"},
+		{Op: "auth", Target: "admin", Arg: "secret"},
+	}
+	expected := []*MessageQuery{
+		{Op: "get", Target: "toto"},
+		{Id: "12", Op: "set", Target: "toto", Arg: "-5"},
+		{Op: "lock", Target: "toto", Arg: "500ms", Mode: "shared", Lease: "2000ms"},
+		{Op: "lockall", Targets: []string{"a", "b"}},
+		{Op: "watch", Target: "to", Mode: "prefix"},
+		{Op: "auth", Target: "admin", Arg: "secret"},
+	}
+	for i, q := range queries {
+		buf, err := AppendBinaryQuery(nil, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := readFrame(bufio.NewReader(&byteReader{buf}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := parseBinaryQuery(body)
+		if err != nil || !reflect.DeepEqual(m, expected[i]) {
+			t.Errorf("Expected %+v, got %+v (%v)", expected[i], m, err)
+		}
+		if _, err := parseBinaryQuery(body[:len(body)-1]); err == nil {
+			t.Error("Truncated frame accepted")
+		}
+	}
+
+	if _, err := AppendBinaryQuery(nil, &MessageQuery{Op: "set", Arg: "x"}); err == nil {
+		t.Error("Invalid number accepted")
+	}
+	if _, err := AppendBinaryQuery(nil, &MessageQuery{Op: "foo"}); err == nil {
+		t.Error("Unknown operation accepted")
+	}
+}
+
+// byteReader reads a byte slice
+type byteReader struct{ b []byte }
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+/*****************************************************************************/
+
+func TestBinaryServer(t *testing.T) {
+
+	c1, c2 := net.Pipe()
+	go NewClient(c1, startShards(1)).serve()
+	c2.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(c2)
+
+	buf := []byte{BinaryMagic}
+	for _, q := range []*MessageQuery{
+		{Id: "1", Op: "set", Target: "toto", Arg: "10"},
+		{Id: "2", Op: "incr", Target: "toto", Arg: "-3"},
+		{Id: "3", Op: "unlock", Target: "toto"},
+		{Id: "4", Op: "watch", Target: "to", Mode: "prefix"},
+		{Id: "5", Op: "set", Target: "toto", Arg: "1"},
+	} {
+		buf, _ = AppendBinaryQuery(buf, q)
+	}
+	go c2.Write(buf)
+
+	for _, e := range []MessageReply{
+		{Id: "1", Status: "OK"},
+		{Id: "2", Status: "OK", Value: "7"},
+		{Id: "3", Status: "KO", Error: "Cannot find this lock"},
+		{Id: "4", Status: "OK"},
+		{Id: "5", Status: "OK"},
+		{Status: "OK", Event: "change", Target: "toto", Value: "1"},
+	} {
+		r, err := ReadBinaryReply(reader)
+		if err != nil || !reflect.DeepEqual(*r, e) {
+			t.Fatalf("Expected %+v, got %+v (%v)", e, r, err)
+		}
+	}
+	c2.Close()
+}
+
+/*****************************************************************************/
+
+// benchmarkProtocol measures the throughput of pipelined incr operations
+// through a TCP connection
+func benchmarkProtocol(b *testing.B, binary bool) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+	go (&Listener{router: startShards(1)}).Serve(lis)
+	con, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer con.Close()
+
+	q := &MessageQuery{Op: "incr", Target: "counter", Arg: "1"}
+	var frame []byte
+	if binary {
+		con.Write([]byte{BinaryMagic})
+		frame, _ = AppendBinaryQuery(nil, q)
+	} else {
+		frame, _ = json.Marshal(q)
+	}
+
+	b.ResetTimer()
+	go func() {
+		writer := bufio.NewWriter(con)
+		for i := 0; i < b.N; i++ {
+			writer.Write(frame)
+		}
+		writer.Flush()
+	}()
+	reader := bufio.NewReader(con)
+	for i := 0; i < b.N; i++ {
+		if binary {
+			_, err = ReadBinaryReply(reader)
+		} else {
+			_, err = reader.ReadBytes('\n')
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProtocolJSON(b *testing.B)   { benchmarkProtocol(b, false) }
+func BenchmarkProtocolBinary(b *testing.B) { benchmarkProtocol(b, true) }
+
+/*****************************************************************************/
@@ -0,0 +1,309 @@
+// This file contains the integration of the core with the Raft cluster. In
+// cluster mode, the events of the clients are not processed when they are
+// received: the leader appends them to the replicated log, and all the nodes
+// apply them once committed, in the same order.
+
+package lockserver
+
+import "fmt"
+import "sort"
+import "strconv"
+
+/*****************************************************************************/
+
+// commands lists the internal events which are replicated, in addition to the
+// client operations.
+var commands = map[string]Operation{
+	"open":    OP_OPEN,
+	"close":   OP_CLOSE,
+	"timeout": OP_TIMEOUT,
+	"expire":  OP_EXPIRE,
+}
+
+/*****************************************************************************/
+
+// clusterClient represents a client in the replicated state. It exists with
+// the same id on all the nodes, but it is only connected on the leader which
+// has accepted it.
+type clusterClient struct {
+	id    string  // Cluster-wide id
+	term  uint64  // Term of the leader which has accepted the client
+	order uint64  // Creation order, for a deterministic iteration
+	local Replier // Local connection, nil on the other nodes
+}
+
+/*****************************************************************************/
+
+// Reply forwards a reply to the local connection of the client, if any
+func (cc *clusterClient) Reply(r *MessageReply) {
+
+	if cc.local != nil {
+		cc.local.Reply(r)
+	}
+}
+
+/*****************************************************************************/
+
+// String returns the id of the client
+func (cc *clusterClient) String() string {
+	return cc.id
+}
+
+/*****************************************************************************/
+
+// Info describes the local connection of the client, if any
+func (cc *clusterClient) Info() *ClientInfo {
+
+	if conn, ok := cc.local.(Connection); ok {
+		return conn.Info()
+	}
+	return nil
+}
+
+/*****************************************************************************/
+
+// Kill closes the local connection of the client, if any
+func (cc *clusterClient) Kill() {
+
+	if conn, ok := cc.local.(Connection); ok {
+		conn.Kill()
+	}
+}
+
+/*****************************************************************************/
+
+// Cluster gathers the cluster state of the core
+type Cluster struct {
+	raft       *Raft                      // Raft node
+	leader     bool                       // True if this node is the leader
+	term       uint64                     // Current term
+	leaderAddr string                     // Client address of the leader
+	count      uint64                     // Number of clients accepted by this node
+	order      uint64                     // Number of clients in the replicated state
+	local      map[Replier]*clusterClient // Local connections, nil until accepted by the leader
+	pending    map[string]*clusterClient  // Accepted clients, not yet committed
+	clients    map[string]*clusterClient  // Clients of the replicated state
+}
+
+/*****************************************************************************/
+
+// NewCluster builds a Cluster object
+func NewCluster(raft *Raft) *Cluster {
+	return &Cluster{
+		raft:    raft,
+		local:   make(map[Replier]*clusterClient),
+		pending: make(map[string]*clusterClient),
+		clients: make(map[string]*clusterClient),
+	}
+}
+
+/*****************************************************************************/
+
+// accept registers a local connection in the cluster. The connection only
+// becomes a client of the replicated state once the open event is committed.
+func (cl *Cluster) accept(clt Replier) *clusterClient {
+
+	cl.count++
+	cc := &clusterClient{id: fmt.Sprintf("%d.%d", cl.term, cl.count), term: cl.term, local: clt}
+	cl.local[clt] = cc
+	cl.pending[cc.id] = cc
+	cl.propose(cc, &MessageQuery{Op: "open"})
+	return cc
+}
+
+/*****************************************************************************/
+
+// propose submits an event of a client to the cluster
+func (cl *Cluster) propose(cc *clusterClient, query *MessageQuery) {
+	cl.raft.Propose(&Command{Term: cl.term, Client: cc.id, Query: query})
+}
+
+/*****************************************************************************/
+
+// intercept replicates an event instead of processing it. It returns false
+// if the event has to be processed locally.
+func (core *Core) intercept(m *MessageQuery) bool {
+
+	cl := core.cluster
+	switch m.oper {
+	case OP_COMMIT, OP_ROLE, OP_SHUTDOWN, OP_CONTENTION:
+		return false
+
+	case OP_OPEN:
+		// The client is only accepted on its first operation, by the leader
+		cl.local[m.clt] = nil
+
+	case OP_CLOSE:
+		cc, ok := cl.local[m.clt]
+		if !ok {
+			// Already disconnected by the core
+			return true
+		}
+		delete(cl.local, m.clt)
+		m.clt.Reply(&MessageReply{oper: OP_CLOSE})
+		if cc != nil {
+			cc.local = nil
+			if cl.leader {
+				cl.propose(cc, &MessageQuery{Op: "close"})
+			}
+		}
+
+	case OP_TIMEOUT, OP_EXPIRE:
+		// Timers only run on the leader. The expiration is replicated, the
+		// intent being identified by its sequence number.
+		if !cl.leader {
+			return true
+		}
+		query := &MessageQuery{Id: m.Id, Op: "timeout", Target: m.intent.name, Arg: strconv.FormatUint(m.intent.seq, 10)}
+		if m.oper == OP_EXPIRE {
+			query.Op, query.Arg = "expire", fmt.Sprintf("%d:%d", m.intent.seq, m.renewal)
+		}
+		cl.propose(m.clt.(*clusterClient), query)
+
+	case OP_NONE:
+		m.reply(&MessageReply{Status: "KO", Error: "Unknown operation"})
+
+	default:
+		// Client operations, including reads, go through the log
+		cc, ok := cl.local[m.clt]
+		if !ok {
+			return true
+		}
+		if !cl.leader {
+			m.reply(&MessageReply{Status: "KO", Error: "Not leader", Value: cl.leaderAddr})
+			return true
+		}
+		if cc == nil {
+			cc = cl.accept(m.clt)
+		}
+		// The position of the query is kept until the entry is committed.
+		// It is only known by the leader, which has the local connection.
+		cl.propose(cc, &MessageQuery{
+			Id:      m.Id,
+			Op:      m.Op,
+			Target:  m.Target,
+			Arg:     m.Arg,
+			Mode:    m.Mode,
+			Lease:   m.Lease,
+			Targets: m.Targets,
+			seq:     m.seq,
+			ordered: m.ordered,
+		})
+		m.held = true
+	}
+	return true
+}
+
+/*****************************************************************************/
+
+// handleCommit applies a committed entry of the replicated log
+func (core *Core) handleCommit(query *MessageQuery) {
+
+	cl := core.cluster
+	cmd := query.command
+	m := *cmd.Query
+	m.committed = true
+
+	// A new leader discards the clients of the previous ones
+	if m.Op == "leader" {
+		core.closeTerms(cmd.Term)
+		return
+	}
+
+	m.oper = Service[m.Op]
+	if oper, ok := commands[m.Op]; ok {
+		m.oper = oper
+	}
+
+	// Resolve the client, creating it on open
+	cc := cl.clients[cmd.Client]
+	if m.oper == OP_OPEN {
+		cc = cl.pending[cmd.Client]
+		if cc == nil {
+			cc = &clusterClient{id: cmd.Client, term: cmd.Term}
+		}
+		delete(cl.pending, cmd.Client)
+		cl.order++
+		cc.order = cl.order
+		cl.clients[cc.id] = cc
+	}
+	if cc == nil {
+		// The client has already been closed
+		return
+	}
+	m.clt = cc
+
+	switch m.oper {
+	case OP_CLOSE:
+		core.closeClient(cc)
+		return
+	case OP_TIMEOUT, OP_EXPIRE:
+		// The intent must not have been replaced meanwhile
+		var seq, renewal uint64
+		fmt.Sscanf(m.Arg, "%d:%d", &seq, &renewal)
+		it := core.locks.Intent(cc, m.Target)
+		if it == nil || it.seq != seq {
+			return
+		}
+		m.intent, m.renewal = it, renewal
+	}
+	core.dispatch(&m)
+	m.processed()
+}
+
+/*****************************************************************************/
+
+// closeTerms closes the clients accepted by the leaders of the previous
+// terms. Their locks are released.
+func (core *Core) closeTerms(term uint64) {
+
+	var old []*clusterClient
+	for _, cc := range core.cluster.clients {
+		if cc.term < term {
+			old = append(old, cc)
+		}
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i].order < old[j].order })
+	for _, cc := range old {
+		core.closeClient(cc)
+	}
+}
+
+/*****************************************************************************/
+
+// closeClient removes a client from the replicated state, and closes its
+// local connection if any.
+func (core *Core) closeClient(cc *clusterClient) {
+
+	delete(core.cluster.clients, cc.id)
+	core.handleClose(&MessageQuery{oper: OP_CLOSE, clt: cc, committed: true})
+	if cc.local != nil {
+		delete(core.cluster.local, cc.local)
+		cc.local = nil
+	}
+}
+
+/*****************************************************************************/
+
+// handleRole processes the role changes of the node. A node losing the
+// leadership disconnects the clients it has accepted: they have to find the
+// new leader.
+func (core *Core) handleRole(query *MessageQuery) {
+
+	cl := core.cluster
+	role := query.role
+	if cl.leader && !role.Leader {
+		core.log.Println("Leadership lost, disconnecting clients")
+		for clt, cc := range cl.local {
+			if cc != nil {
+				cc.local = nil
+				delete(cl.local, clt)
+				clt.Reply(&MessageReply{oper: OP_CLOSE})
+			}
+		}
+		cl.pending = make(map[string]*clusterClient)
+	}
+	cl.leader, cl.term, cl.leaderAddr = role.Leader, role.Term, role.LeaderAddr
+}
+
+/*****************************************************************************/
@@ -0,0 +1,268 @@
+package lockserver
+
+import "bufio"
+import "encoding/json"
+import "fmt"
+import "net"
+import "os/exec"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// startCluster starts the nodes of a cluster, communicating through the
+// loopback interface. The client address of node i is "node-i".
+func startCluster(t *testing.T, n int) ([]*Core, []*Raft) {
+
+	var peers []string
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, lis.Addr().String())
+		listeners = append(listeners, lis)
+	}
+
+	var cores []*Core
+	var rafts []*Raft
+	for i := 0; i < n; i++ {
+		store, err := OpenRaftStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		core := NewCore(DefaultOptions())
+		raft := NewRaft(i, peers, fmt.Sprintf("node-%d", i), 5*time.Millisecond, core, store)
+		core.cluster = NewCluster(raft)
+		go core.main()
+		raft.Start(listeners[i])
+		cores, rafts = append(cores, core), append(rafts, raft)
+	}
+	return cores, rafts
+}
+
+// findLeader waits until one of the given nodes accepts the operations
+func findLeader(t *testing.T, cores []*Core, nodes ...int) int {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		for _, n := range nodes {
+			c := newReplier(cores[n])
+			c.send("get", "toto", "")
+			select {
+			case m := <-c.out:
+				c.close()
+				if m.Status == "OK" {
+					return n
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("No reply")
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return -1
+}
+
+/*****************************************************************************/
+
+func TestCluster(t *testing.T) {
+
+	cores, rafts := startCluster(t, 3)
+	defer func() {
+		for _, r := range rafts {
+			r.Stop()
+		}
+	}()
+	leader := findLeader(t, cores, 0, 1, 2)
+
+	// The followers redirect the clients to the leader
+	follower := (leader + 1) % 3
+	f := newReplier(cores[follower])
+	f.send("set", "toto", "1")
+	if m := f.expect(t, "KO"); m.Error != "Not leader" || m.Value != fmt.Sprintf("node-%d", leader) {
+		t.Error("Wrong redirection", m)
+	}
+
+	// Operations through the leader
+	c1, c2 := newReplier(cores[leader]), newReplier(cores[leader])
+	c1.send("set", "toto", "10")
+	c1.expect(t, "OK")
+	c1.send("incr", "toto", "5")
+	c1.expect(t, "OK")
+	c1.send("lock", "titi", "")
+	token, _ := strconv.ParseUint(c1.expect(t, "OK").Value, 10, 64)
+	c2.send("lock", "titi", "")
+	c2.silent(t, 20*time.Millisecond)
+
+	// Kill the leader: another node takes over, with the same state
+	rafts[leader].Stop()
+	others := []int{(leader + 1) % 3, (leader + 2) % 3}
+	next := findLeader(t, cores, others...)
+	c3 := newReplier(cores[next])
+	c3.send("get", "toto", "")
+	if m := c3.expect(t, "OK"); m.Value != "15" {
+		t.Error("Wrong value", m.Value)
+	}
+
+	// The locks of the clients of the previous leader have been released
+	c3.send("lock", "titi", "")
+	if m := c3.expect(t, "OK"); m.Value == "" {
+		t.Error("Missing fencing token")
+	} else if v, _ := strconv.ParseUint(m.Value, 10, 64); v <= token {
+		t.Error("Fencing token not increased", v, token)
+	}
+}
+
+/*****************************************************************************/
+
+func TestRaftCommittedConflict(t *testing.T) {
+
+	store, err := OpenRaftStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	r := NewRaft(1, []string{"a", "b"}, "node-1", time.Second, NewCore(DefaultOptions()), store)
+
+	// The first entry is committed
+	r.handleAppend(&raftMessage{Type: RAFT_APPEND, From: 0, Term: 1, Entries: []Entry{{Term: 1}}, Commit: 1})
+	if r.commit != 1 {
+		t.Fatal("Entry not committed")
+	}
+
+	// A conflicting entry cannot replace it: the append is rejected
+	r.pending = nil
+	r.handleAppend(&raftMessage{Type: RAFT_APPEND, From: 0, Term: 2, Entries: []Entry{{Term: 2}}, Commit: 1})
+	if len(r.pending) != 1 || r.pending[0].Success || r.lastIndex() != 1 || r.log[1].Term != 1 {
+		t.Error("Committed entry overwritten")
+	}
+}
+
+/*****************************************************************************/
+
+// buildLockctl builds the server binary in a temporary directory. The test
+// is skipped in short mode.
+func buildLockctl(t *testing.T) (string, string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Builds and runs lockctl")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "lockctl")
+	if out, err := exec.Command("go", "build", "-o", bin, "../lockctl").CombinedOutput(); err != nil {
+		t.Fatal("Cannot build lockctl: ", err, string(out))
+	}
+	return dir, bin
+}
+
+// freeAddrs returns some loopback addresses whose ports were free
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+	var addrs []string
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, lis.Addr().String())
+		defer lis.Close()
+	}
+	return addrs
+}
+
+// query sends a query to a server, and returns its reply, or nil if the
+// server cannot be reached
+func query(addr string, q *MessageQuery) *MessageReply {
+
+	con, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil
+	}
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(2 * time.Second))
+	json.NewEncoder(con).Encode(q)
+	m := &MessageReply{}
+	if err := json.NewDecoder(bufio.NewReader(con)).Decode(m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// findProcessLeader waits until one of the given servers accepts the
+// operations
+func findProcessLeader(t *testing.T, addrs []string, nodes ...int) int {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		for _, n := range nodes {
+			if m := query(addrs[n], &MessageQuery{Op: "get", Target: "toto"}); m != nil && m.Status == "OK" {
+				return n
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("No leader elected")
+	return -1
+}
+
+/*****************************************************************************/
+
+func TestClusterProcesses(t *testing.T) {
+
+	dir, bin := buildLockctl(t)
+
+	// Three servers on the loopback interface, each one with its own Raft
+	// state directory
+	addrs, peers := freeAddrs(t, 3), freeAddrs(t, 3)
+	procs := make([]*exec.Cmd, 3)
+	start := func(i int) {
+		cmd := exec.Command(bin, "-l", "-s", addrs[i], "-monitor", "", "-cluster", strings.Join(peers, ","),
+			"-node", strconv.Itoa(i), "-d", filepath.Join(dir, strconv.Itoa(i)))
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		procs[i] = cmd
+	}
+	kill := func(i int) {
+		procs[i].Process.Kill()
+		procs[i].Wait()
+	}
+	for i := range procs {
+		start(i)
+	}
+	defer func() {
+		for _, cmd := range procs {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+
+	leader := findProcessLeader(t, addrs, 0, 1, 2)
+	if m := query(addrs[leader], &MessageQuery{Op: "set", Target: "toto", Arg: "10"}); m == nil || m.Status != "OK" {
+		t.Fatal("Wrong reply", m)
+	}
+
+	// Kill the leader process: another node takes over, with the same state
+	kill(leader)
+	others := []int{(leader + 1) % 3, (leader + 2) % 3}
+	next := findProcessLeader(t, addrs, others...)
+	if m := query(addrs[next], &MessageQuery{Op: "incr", Target: "toto", Arg: "5"}); m == nil || m.Value != "15" {
+		t.Fatal("Wrong reply", m)
+	}
+
+	// Restart the old leader, then kill the new one: the restarted node
+	// has kept its log, and forms the majority with the last node
+	start(leader)
+	time.Sleep(500 * time.Millisecond)
+	kill(next)
+	last := findProcessLeader(t, addrs, leader, 3-leader-next)
+	if m := query(addrs[last], &MessageQuery{Op: "get", Target: "toto"}); m == nil || m.Value != "15" {
+		t.Error("Wrong reply", m)
+	}
+}
+
+/*****************************************************************************/
@@ -3,6 +3,9 @@
 package lockserver
 
 import "container/list"
+import "sort"
+import "strconv"
+import "time"
 
 /*****************************************************************************/
 
@@ -13,11 +16,88 @@ type Replier interface {
 
 /*****************************************************************************/
 
+// epochShift is the position of the fencing epoch in the fencing tokens
+const epochShift = 40
+
+/*****************************************************************************/
+
+// Intent represents the will of a client to own a lock. The intent is either
+// granted (the client holds the lock), or queued behind the current holders.
+// A lock is held either by a single exclusive intent, or by several shared
+// intents.
+type Intent struct {
+	clt     Replier       // Client owning the intent
+	name    string        // Name of the lock
+	id      string        // Id of the lock request, echoed in the deferred reply
+	shared  bool          // True for a shared (reader) lock
+	granted bool          // True if the lock has been granted to the client
+	elem    *list.Element // Position in the lock list, nil once removed
+	token   uint64        // Fencing token, set when the lock is granted
+	lease   time.Duration // Lease duration, zero if the lock has no lease
+	renewal uint64        // Lease renewal counter of a granted lock
+	group   *Group        // Group of an atomic multi-lock request, or nil
+	seq     uint64        // Sequence number, giving the age of the intent
+	since   time.Time     // Time of the lock request
+	reply   uint64        // Position of the request in an ordered connection, kept by the deferred reply
+	timer   *time.Timer   // Timeout of a queued intent, or lease of a granted one, nil if none
+}
+
+/*****************************************************************************/
+
+// Group gathers the intents of an atomic multi-lock request. Its intents are
+// queued at once, and the client is only notified when all of them have been
+// granted. Because the intents of a group are all queued in the same core
+// event, two groups are always ordered in the same way in all the lock lists
+// they share, so groups cannot deadlock each other.
+type Group struct {
+	id      string      // Id of the lock request, echoed in the reply
+	intents []*Intent   // Intents of the group, in request order
+	pending int         // Number of intents not granted yet
+	done    bool        // True once the client has been notified
+	timer   *time.Timer // Timeout of the whole group, nil if none
+}
+
+/*****************************************************************************/
+
+// fencingToken returns the fencing token of the intent, formatted for a reply
+func (it *Intent) fencingToken() string {
+	return strconv.FormatUint(it.token, 10)
+}
+
+/*****************************************************************************/
+
+// held returns true if the lock is granted and can be used by the client. The
+// intents of a group are only usable once the whole group is granted.
+func (it *Intent) held() bool {
+	return it.granted && (it.group == nil || it.group.pending == 0)
+}
+
+/*****************************************************************************/
+
+// stopTimer stops the timer of an intent or a group, if any
+func stopTimer(t **time.Timer) {
+
+	if *t != nil {
+		(*t).Stop()
+		*t = nil
+	}
+}
+
+/*****************************************************************************/
+
 // LockArea is the data structure responsible of tracking who locks what, and
-// what is locked by who.
+// what is locked by who. For each lock, the granted intents are always at the
+// front of the list, followed by the queued intents in FIFO order.
 type LockArea struct {
-	locks   map[string]*list.List       // Map associating locks to list of clients
-	clients map[Replier]map[string]bool // Map associating repliers to map of locks
+	locks   map[string]*list.List          // Map associating locks to list of intents
+	clients map[Replier]map[string]*Intent // Map associating repliers to map of intents
+	fence   uint64                         // Last fencing token counter
+	epoch   uint64                         // Fencing epoch
+	seq     uint64                         // Last intent sequence number
+	intents int                            // Number of intents in the lock lists
+	granted int                            // Number of granted intents
+	waiting map[string]int                 // Number of queued intents, by lock
+	waits   *histogram                     // Wait time of the granted intents, nil if not measured
 }
 
 /*****************************************************************************/
@@ -26,73 +106,378 @@ type LockArea struct {
 func NewLockArea() *LockArea {
 	return &LockArea{
 		locks:   make(map[string]*list.List),
-		clients: make(map[Replier]map[string]bool),
+		clients: make(map[Replier]map[string]*Intent),
+		waiting: make(map[string]int),
 	}
 }
 
 /*****************************************************************************/
 
-// Add must be called to notify a locking event
+// Add must be called to notify an exclusive locking event
 func (lo *LockArea) Add(clt Replier, name string) bool {
 
+	return lo.AddMode(clt, name, false)
+}
+
+/*****************************************************************************/
+
+// AddMode must be called to notify a locking event in shared or exclusive
+// mode. It returns true if the lock is granted. If the client has already an
+// intent on the lock, its mode is kept: the callers reject a request in
+// another mode.
+func (lo *LockArea) AddMode(clt Replier, name string, shared bool) bool {
+
+	// Check if the client has already a lock intent on the same object
+	if it, ok := lo.clients[clt][name]; ok {
+		// Yes: just ignore, and only reply if the lock is already granted
+		return it.held()
+	}
+
+	return lo.add(&Intent{clt: clt, name: name, shared: shared})
+}
+
+/*****************************************************************************/
+
+// AddGroup must be called to notify an atomic locking event on several locks.
+// The client must not have any intent on these locks yet. It returns the
+// group, and true if all the locks are granted.
+func (lo *LockArea) AddGroup(clt Replier, names []string, shared bool) (*Group, bool) {
+
+	g := &Group{pending: len(names)}
+	for _, name := range names {
+		it := &Intent{clt: clt, name: name, shared: shared, group: g}
+		g.intents = append(g.intents, it)
+		lo.add(it)
+	}
+	return g, g.pending == 0
+}
+
+/*****************************************************************************/
+
+// add queues a new intent, and grants the lock if possible
+func (lo *LockArea) add(it *Intent) bool {
+
 	// Check if lock already exists
+	name, shared := it.name, it.shared
+	lo.seq++
+	it.seq, it.since = lo.seq, time.Now()
+	lo.intents++
+	lo.clients[it.clt][name] = it
 	if clist, ok := lo.locks[name]; ok {
-		// Check if the client has already locked the same object
-		if clist.Front().Value.(Replier) != clt {
-			// No: client is just queued, do no reply
-			clist.PushBack(clt)
-			lo.clients[clt][name] = false
-			return false
+		// Shared intents join the shared holders if nobody is queued,
+		// otherwise the client is just queued, do no reply
+		if lo.Grantable(name, shared) {
+			lo.grant(it)
 		} else {
-			// Yes: just ignore and reply
-			return true
+			lo.waiting[name]++
 		}
+		it.elem = clist.PushBack(it)
+		return it.granted
 	} else {
 		// Create new lock object and grant it to the client, and reply
 		clist = list.New()
-		clist.PushBack(clt)
+		it.elem = clist.PushBack(it)
+		lo.grant(it)
 		lo.locks[name] = clist
-		lo.clients[clt][name] = true
 		return true
 	}
 }
 
 /*****************************************************************************/
 
-// Remove is called to notify an unlock
-func (lo *LockArea) Remove(clt Replier, name string) (Replier, bool) {
+// Grantable returns true if a new intent in the given mode would be granted
+// immediately.
+func (lo *LockArea) Grantable(name string, shared bool) bool {
+
+	clist, ok := lo.locks[name]
+	if !ok {
+		return true
+	}
+	// Since granted intents are at the front, the last intent is granted only
+	// if nobody is queued. If it is shared, all the holders are shared.
+	last := clist.Back().Value.(*Intent)
+	return shared && last.shared && last.granted
+}
+
+/*****************************************************************************/
+
+// Intent returns the lock intent of a client on a given lock, or nil
+func (lo *LockArea) Intent(clt Replier, name string) *Intent {
+
+	return lo.clients[clt][name]
+}
+
+/*****************************************************************************/
+
+// Intents returns all the lock intents of a client, from the oldest to the
+// youngest. The order does not depend on map iteration, so that the same
+// operations always produce the same grants and fencing tokens.
+func (lo *LockArea) Intents(clt Replier) []*Intent {
+
+	res := make([]*Intent, 0, len(lo.clients[clt]))
+	for _, it := range lo.clients[clt] {
+		res = append(res, it)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].seq < res[j].seq })
+	return res
+}
+
+/*****************************************************************************/
+
+// Holders returns the clients currently holding a lock. The result is empty
+// if the lock is free.
+func (lo *LockArea) Holders(name string) []Replier {
+
+	res := []Replier{}
+	if clist, ok := lo.locks[name]; ok {
+		for e := clist.Front(); e != nil && e.Value.(*Intent).granted; e = e.Next() {
+			res = append(res, e.Value.(*Intent).clt)
+		}
+	}
+	return res
+}
+
+/*****************************************************************************/
+
+// Queue returns the intents of a lock in queue order: the holders first, then
+// the waiters.
+func (lo *LockArea) Queue(name string) []*Intent {
+
+	res := []*Intent{}
+	if clist, ok := lo.locks[name]; ok {
+		for e := clist.Front(); e != nil; e = e.Next() {
+			res = append(res, e.Value.(*Intent))
+		}
+	}
+	return res
+}
+
+/*****************************************************************************/
+
+// Clients returns all the clients of the lock area, in no particular order
+func (lo *LockArea) Clients() []Replier {
+
+	res := make([]Replier, 0, len(lo.clients))
+	for clt := range lo.clients {
+		res = append(res, clt)
+	}
+	return res
+}
+
+/*****************************************************************************/
+
+// Remove is called to notify an unlock. It returns the intents for which the
+// lock has been granted as a consequence.
+func (lo *LockArea) Remove(clt Replier, name string) ([]*Intent, bool) {
 
 	// Sanity check: the lock must exist
-	clist, lok := lo.locks[name]
-	if !lok {
+	if _, lok := lo.locks[name]; !lok {
 		return nil, false
 	}
 	// Sanity check: the client must hold the lock
-	if present := lo.clients[clt][name]; !present {
+	it, present := lo.clients[clt][name]
+	if !present || !it.held() {
 		return nil, false
 	}
-	e := clist.Front()
-	c := e.Value.(Replier)
-	if c != clt {
-		panic("LockArea data structure is corrupted")
+
+	// Remove intent from lock list, delete lock from client map
+	return lo.unlink(it), true
+}
+
+/*****************************************************************************/
+
+// Cancel removes a lock intent which has not been granted yet. It returns
+// false if the intent is not queued anymore (already granted or removed).
+// Removing a queued exclusive intent may let the next shared intents in, so
+// the newly granted intents are returned as well.
+func (lo *LockArea) Cancel(it *Intent) ([]*Intent, bool) {
+
+	if it.elem == nil || it.granted {
+		return nil, false
 	}
+	return lo.unlink(it), true
+}
 
-	// Remove clients from lock list, delete lock from client map
-	clist.Remove(e)
-	delete(lo.clients[clt], name)
+/*****************************************************************************/
 
-	// Check whether the lock can be granted to another client
-	e = clist.Front()
-	if e == nil {
-		// No other lock intent
-		delete(lo.locks, name)
-		return nil, true
+// CancelGroup removes all the intents of a group which has not been fully
+// granted yet. The locks which were already granted to the group are
+// released. It returns false if the group is complete or has been removed.
+func (lo *LockArea) CancelGroup(g *Group) ([]*Intent, bool) {
+
+	if g.pending == 0 || g.intents[0].elem == nil {
+		return nil, false
+	}
+	stopTimer(&g.timer)
+
+	res := []*Intent{}
+	for _, it := range g.intents {
+		res = append(res, lo.unlink(it)...)
+	}
+	return res, true
+}
+
+/*****************************************************************************/
+
+// unlink removes an intent from the data structure, and grants the lock to
+// the next eligible intents, which are returned.
+func (lo *LockArea) unlink(it *Intent) []*Intent {
+
+	clist := lo.locks[it.name]
+	clist.Remove(it.elem)
+	it.elem = nil
+	stopTimer(&it.timer)
+	lo.intents--
+	if it.granted {
+		lo.granted--
 	} else {
-		// Found a lock intent: grant the lock
-		c = e.Value.(Replier)
-		lo.clients[c][name] = true
-		return c, true
+		lo.dequeue(it.name)
+	}
+	delete(lo.clients[it.clt], it.name)
+
+	// Check whether the lock can be granted to other clients
+	if clist.Front() == nil {
+		// No other lock intent
+		delete(lo.locks, it.name)
+		return nil
+	}
+	return lo.promote(clist)
+}
+
+/*****************************************************************************/
+
+// promote grants a lock to the queued intents which are compatible with the
+// current holders, in FIFO order. A queued exclusive intent is granted only
+// when there is no holder anymore, and it stops the scan so that the
+// following shared intents cannot starve it.
+func (lo *LockArea) promote(clist *list.List) []*Intent {
+
+	res := []*Intent{}
+	for e := clist.Front(); e != nil; e = e.Next() {
+		it := e.Value.(*Intent)
+		if it.granted {
+			if !it.shared {
+				break
+			}
+			continue
+		}
+		if !it.shared {
+			if e == clist.Front() {
+				lo.dequeue(it.name)
+				lo.grant(it)
+				res = append(res, it)
+			}
+			break
+		}
+		lo.dequeue(it.name)
+		lo.grant(it)
+		res = append(res, it)
 	}
+	return res
+}
+
+/*****************************************************************************/
+
+// dequeue counts a queued intent leaving the queue of a lock
+func (lo *LockArea) dequeue(name string) {
+
+	if lo.waiting[name]--; lo.waiting[name] == 0 {
+		delete(lo.waiting, name)
+	}
+}
+
+/*****************************************************************************/
+
+// grant marks an intent as granted, and gives it a new fencing token. Tokens
+// are strictly increasing, so a holder can be told apart from the previous
+// holders of the same lock. The epoch is stored in the high bits of the token,
+// so that the tokens granted after a promotion are greater than the previous
+// ones. The epoch only survives a restart when the server has a persistence
+// directory: otherwise, it starts again from 0.
+func (lo *LockArea) grant(it *Intent) {
+
+	lo.fence++
+	lo.granted++
+	it.granted = true
+	it.token = lo.epoch<<epochShift | lo.fence
+	stopTimer(&it.timer)
+	if lo.waits != nil {
+		lo.waits.observe(time.Since(it.since))
+	}
+	if it.group != nil {
+		if it.group.pending--; it.group.pending == 0 {
+			stopTimer(&it.group.timer)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// SetEpoch starts a new fencing epoch. All the tokens granted from now on are
+// greater than the tokens granted during the previous epochs.
+func (lo *LockArea) SetEpoch(epoch uint64) {
+
+	lo.epoch = epoch
+	lo.fence = 0
+}
+
+/*****************************************************************************/
+
+// Check returns true if a fencing token belongs to a current holder of a lock
+func (lo *LockArea) Check(name string, token uint64) bool {
+
+	if clist, ok := lo.locks[name]; ok {
+		for e := clist.Front(); e != nil && e.Value.(*Intent).granted; e = e.Next() {
+			if it := e.Value.(*Intent); it.held() && it.token == token {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*****************************************************************************/
+
+// Counts returns the number of granted intents, and of queued intents
+func (lo *LockArea) Counts() (int, int) {
+	return lo.granted, lo.intents - lo.granted
+}
+
+/*****************************************************************************/
+
+// Contention describes a lock with queued intents
+type Contention struct {
+	Name    string
+	Waiters int
+}
+
+// Contended returns at most n locks having the most queued intents, the most
+// contended first
+func (lo *LockArea) Contended(n int) []Contention {
+
+	res := make([]Contention, 0, len(lo.waiting))
+	for name, waiters := range lo.waiting {
+		res = append(res, Contention{Name: name, Waiters: waiters})
+	}
+	sortContention(res)
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+/*****************************************************************************/
+
+// sortContention sorts some locks by decreasing number of queued intents,
+// then by name
+func sortContention(cs []Contention) {
+
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].Waiters != cs[j].Waiters {
+			return cs[i].Waiters > cs[j].Waiters
+		}
+		return cs[i].Name < cs[j].Name
+	})
 }
 
 /*****************************************************************************/
@@ -100,34 +485,22 @@ func (lo *LockArea) Remove(clt Replier, name string) (Replier, bool) {
 // AddClient is called to notify a new client
 func (lo *LockArea) AddClient(clt Replier) {
 
-	lo.clients[clt] = make(map[string]bool)
+	lo.clients[clt] = make(map[string]*Intent)
 }
 
 /*****************************************************************************/
 
 // Remove client is called to notify a client disconnection.
-// It can be due to a normal disconnection, or a crash.
-func (lo *LockArea) RemoveClient(clt Replier) []Replier {
+// It can be due to a normal disconnection, or a crash. It returns the intents
+// of the other clients for which the locks have been regranted.
+func (lo *LockArea) RemoveClient(clt Replier) []*Intent {
 
-	res := []Replier{}
+	res := []*Intent{}
 
-	// Iterate on all the locks related to the client
-	for name, locked := range lo.clients[clt] {
-		if locked {
-			// This lock was granted to the client, it must be released
-			if next, _ := lo.Remove(clt, name); next != nil {
-				res = append(res, next)
-			}
-		} else {
-			// This was only a lock intent, but it has to be removed
-			l := lo.locks[name]
-			FilterOut(l, func(e *list.Element) bool {
-				return e.Value.(Replier) == clt
-			})
-			if l.Front() == nil {
-				delete(lo.locks, name)
-			}
-		}
+	// Iterate on all the locks related to the client. Granted locks must be
+	// released, and simple lock intents have to be removed.
+	for _, it := range lo.Intents(clt) {
+		res = append(res, lo.unlink(it)...)
 	}
 
 	delete(lo.clients, clt)
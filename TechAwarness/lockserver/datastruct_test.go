@@ -2,6 +2,7 @@ package lockserver
 
 import "testing"
 import "fmt"
+import "time"
 
 /*****************************************************************************/
 
@@ -24,7 +25,7 @@ func TestLockArea(t *testing.T) {
 	}
 
 	var ret bool
-	var r Replier
+	var r []*Intent
 
 	ret = la.Add(c[0], "toto")
 	if ret != true {
@@ -39,15 +40,15 @@ func TestLockArea(t *testing.T) {
 		t.Error("Add succeeded c2")
 	}
 	r, ret = la.Remove(c[1], "toto")
-	if ret == true || r != nil {
+	if ret == true || len(r) != 0 {
 		t.Error("Remove oddity c1")
 	}
 	r, ret = la.Remove(c[0], "toto")
-	if ret == false || r != c[1] {
+	if ret == false || len(r) != 1 || r[0].clt != c[1] {
 		t.Error("Remove failed c0")
 	}
 	r, ret = la.Remove(c[1], "toto")
-	if ret == false || r != c[2] {
+	if ret == false || len(r) != 1 || r[0].clt != c[2] {
 		t.Error("Remove failed c1")
 	}
 	ret = la.Add(c[0], "toto")
@@ -58,13 +59,262 @@ func TestLockArea(t *testing.T) {
 		t.Error("Wrong locks length")
 	}
 	rr := la.RemoveClient(c[2])
-	if len(rr) != 1 || rr[0] != c[0] {
+	if len(rr) != 1 || rr[0].clt != c[0] {
 		t.Error("RemoveClient c2 wrong")
 	}
 }
 
 /*****************************************************************************/
 
+func TestLockAreaCancel(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [3]*clt
+	for i := 0; i < 3; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+
+	la.Add(c[0], "toto")
+	la.Add(c[1], "toto")
+	la.Add(c[2], "toto")
+	if la.Add(c[1], "toto") || la.locks["toto"].Len() != 3 {
+		t.Error("Duplicate lock intent c1")
+	}
+	if _, ok := la.Cancel(la.Intent(c[0], "toto")); ok {
+		t.Error("Cancel succeeded on granted lock c0")
+	}
+	it := la.Intent(c[1], "toto")
+	if _, ok := la.Cancel(it); !ok || la.Intent(c[1], "toto") != nil {
+		t.Error("Cancel failed c1")
+	}
+	if _, ok := la.Cancel(it); ok {
+		t.Error("Cancel succeeded twice c1")
+	}
+	r, ret := la.Remove(c[0], "toto")
+	if ret == false || len(r) != 1 || r[0].clt != c[2] {
+		t.Error("Remove failed c0")
+	}
+	la.Remove(c[2], "toto")
+	if len(la.locks) != 0 {
+		t.Error("Lock not deleted")
+	}
+}
+
+/*****************************************************************************/
+
+func TestLockAreaShared(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [5]*clt
+	for i := 0; i < 5; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+
+	// Readers share the lock, a writer queues behind them
+	if !la.AddMode(c[0], "toto", true) || !la.AddMode(c[1], "toto", true) {
+		t.Error("Shared lock not granted c0 c1")
+	}
+	if la.AddMode(c[2], "toto", false) {
+		t.Error("Exclusive lock granted c2")
+	}
+	// Readers arriving after a writer must not starve it
+	if la.AddMode(c[3], "toto", true) || la.AddMode(c[4], "toto", true) {
+		t.Error("Shared lock granted c3 c4")
+	}
+	if len(la.Holders("toto")) != 2 {
+		t.Error("Wrong holders")
+	}
+
+	r, _ := la.Remove(c[0], "toto")
+	if len(r) != 0 {
+		t.Error("Lock regranted c0")
+	}
+	r, _ = la.Remove(c[1], "toto")
+	if len(r) != 1 || r[0].clt != c[2] {
+		t.Error("Exclusive lock not granted c2")
+	}
+
+	// When the writer leaves, all the queued readers get the lock at once
+	rr := la.RemoveClient(c[2])
+	if len(rr) != 2 || rr[0].clt != c[3] || rr[1].clt != c[4] {
+		t.Error("Shared locks not granted c3 c4")
+	}
+}
+
+/*****************************************************************************/
+
+func TestLockAreaCancelShared(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [3]*clt
+	for i := 0; i < 3; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+
+	la.AddMode(c[0], "toto", true)
+	la.AddMode(c[1], "toto", false)
+	la.AddMode(c[2], "toto", true)
+
+	// Cancelling the queued writer lets the next reader in
+	r, ok := la.Cancel(la.Intent(c[1], "toto"))
+	if !ok || len(r) != 1 || r[0].clt != c[2] {
+		t.Error("Cancel failed c1")
+	}
+	if !la.Grantable("toto", true) || la.Grantable("toto", false) {
+		t.Error("Wrong grantable status")
+	}
+}
+
+/*****************************************************************************/
+
+func TestLockAreaGroup(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [3]*clt
+	for i := 0; i < 3; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+
+	la.Add(c[0], "tutu")
+	g1, ok := la.AddGroup(c[1], []string{"toto", "tutu"}, false)
+	if ok || g1.pending != 1 {
+		t.Error("Group granted c1")
+	}
+	g2, ok := la.AddGroup(c[2], []string{"tutu", "toto"}, false)
+	if ok || g2.pending != 2 {
+		t.Error("Group granted c2")
+	}
+
+	// A partially granted group does not hold its locks yet
+	if _, ok := la.Remove(c[1], "toto"); ok {
+		t.Error("Remove succeeded c1")
+	}
+	if la.Check("toto", la.Intent(c[1], "toto").token) {
+		t.Error("Check succeeded c1")
+	}
+
+	r, _ := la.Remove(c[0], "tutu")
+	if len(r) != 1 || r[0].group != g1 || g1.pending != 0 {
+		t.Error("Group not granted c1")
+	}
+
+	// Cancelling a group releases the locks it has already got
+	r, ok = la.CancelGroup(g1)
+	if ok || len(r) != 0 {
+		t.Error("Complete group cancelled c1")
+	}
+	la.RemoveClient(c[1])
+	if g2.pending != 0 {
+		t.Error("Group not granted c2")
+	}
+	la.AddClient(c[1])
+	la.Add(c[0], "titi")
+	g3, _ := la.AddGroup(c[1], []string{"tata", "titi"}, true)
+	r, ok = la.CancelGroup(g3)
+	if !ok || len(r) != 0 || len(la.Holders("tata")) != 0 || la.locks["titi"].Len() != 1 {
+		t.Error("CancelGroup failed c1")
+	}
+}
+
+/*****************************************************************************/
+
+func TestLockAreaDeadlock(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [3]*clt
+	for i := 0; i < 3; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+
+	// Readers waiting behind each other do not deadlock
+	la.Add(c[0], "toto")
+	la.AddMode(c[1], "toto", true)
+	la.AddMode(c[2], "toto", true)
+	if la.Deadlock(c[2]) != nil {
+		t.Error("Deadlock found c2")
+	}
+
+	la.RemoveClient(c[0])
+	la.RemoveClient(c[1])
+	la.RemoveClient(c[2])
+
+	// c0 -> c1 -> c2 -> c0
+	for i := 0; i < 3; i++ {
+		la.AddClient(c[i])
+	}
+	la.Add(c[0], "toto")
+	la.Add(c[1], "tutu")
+	la.Add(c[2], "titi")
+	la.Add(c[0], "tutu")
+	la.Add(c[1], "titi")
+	if la.Deadlock(c[1]) != nil {
+		t.Error("Deadlock found c1")
+	}
+	la.Add(c[2], "toto")
+	cycle := la.Deadlock(c[2])
+	if len(cycle) != 3 {
+		t.Fatal("Deadlock not found c2")
+	}
+	if v := Victim(cycle); v != la.Intent(c[2], "toto") {
+		t.Error("Wrong victim", v.clt, v.name)
+	}
+}
+
+/*****************************************************************************/
+
+func TestLockAreaTimers(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [3]*clt
+	for i := 0; i < 3; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+	timer := func() *time.Timer { return time.AfterFunc(time.Hour, func() {}) }
+
+	// The timers are stopped when the intents are granted, cancelled or
+	// removed
+	la.Add(c[0], "toto")
+	la.Add(c[1], "toto")
+	la.Add(c[2], "toto")
+	it0, it1, it2 := la.Intent(c[0], "toto"), la.Intent(c[1], "toto"), la.Intent(c[2], "toto")
+	t0, t1, t2 := timer(), timer(), timer()
+	it0.timer, it1.timer, it2.timer = t0, t1, t2
+	la.Cancel(it2)
+	if it2.timer != nil || t2.Stop() {
+		t.Error("Timer not stopped on cancel")
+	}
+	la.Remove(c[0], "toto")
+	if it0.timer != nil || t0.Stop() {
+		t.Error("Timer not stopped on remove")
+	}
+	if it1.timer != nil || t1.Stop() {
+		t.Error("Timer not stopped on grant")
+	}
+
+	// The timer of a group is stopped once the whole group is granted
+	g, _ := la.AddGroup(c[2], []string{"toto", "titi"}, false)
+	tg := timer()
+	g.timer = tg
+	la.Remove(c[1], "toto")
+	if g.pending != 0 || g.timer != nil || tg.Stop() {
+		t.Error("Group timer not stopped")
+	}
+}
+
+/*****************************************************************************/
+
 func ExampleLockArea() {
 
 	la := NewLockArea()
@@ -83,7 +333,7 @@ func ExampleLockArea() {
 	}
 
 	for e := la.locks["toto"].Front(); e != nil; e = e.Next() {
-		fmt.Println(e.Value.(*clt))
+		fmt.Println(e.Value.(*Intent).clt.(*clt))
 	}
 
 	// Output:
@@ -109,3 +359,45 @@ func BenchmarkLockArea(b *testing.B) {
 }
 
 /*****************************************************************************/
+
+func TestLockAreaContention(t *testing.T) {
+
+	la := NewLockArea()
+
+	var c [4]*clt
+	for i := 0; i < 4; i++ {
+		c[i] = &clt{n: i}
+		la.AddClient(c[i])
+	}
+
+	// Two readers hold toto, a writer and a reader are queued; titi has one waiter
+	la.AddMode(c[0], "toto", true)
+	la.AddMode(c[1], "toto", true)
+	la.AddMode(c[2], "toto", false)
+	la.AddMode(c[3], "toto", true)
+	la.Add(c[0], "titi")
+	la.Add(c[1], "titi")
+	if held, queued := la.Counts(); held != 3 || queued != 3 {
+		t.Error("Wrong counts", held, queued)
+	}
+	if cs := la.Contended(10); fmt.Sprint(cs) != "[{toto 2} {titi 1}]" {
+		t.Error("Wrong contention", cs)
+	}
+	if cs := la.Contended(1); len(cs) != 1 || cs[0].Name != "toto" {
+		t.Error("Wrong top contention", cs)
+	}
+
+	// The writer gets toto, the queued readers are cancelled with their client
+	la.Remove(c[0], "toto")
+	la.Remove(c[1], "toto")
+	la.RemoveClient(c[3])
+	la.RemoveClient(c[1])
+	if held, queued := la.Counts(); held != 2 || queued != 0 {
+		t.Error("Wrong counts", held, queued)
+	}
+	if cs := la.Contended(10); len(cs) != 0 {
+		t.Error("Wrong contention", cs)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,69 @@
+// This file contains the deadlock detection code.
+
+package lockserver
+
+/*****************************************************************************/
+
+// Deadlock looks for a cycle in the wait-for graph going through a given
+// client. The graph is not stored: it is derived from the lock lists. A
+// client waits for another one if one of its queued intents is behind an
+// intent of the other client, and at least one of the two intents is
+// exclusive. Since edges only appear when an intent is queued, it is enough
+// to check the client of each new queued intent.
+//
+// It returns the queued intents forming the cycle, or nil if there is no
+// deadlock.
+func (lo *LockArea) Deadlock(clt Replier) []*Intent {
+
+	visited := make(map[Replier]bool)
+	path := []*Intent{}
+
+	// Depth first search from the client, until the client is reached again
+	var visit func(c Replier) bool
+	visit = func(c Replier) bool {
+		visited[c] = true
+		for _, w := range lo.Intents(c) {
+			if w.granted {
+				continue
+			}
+			// Iterate on the intents ahead of the queued one
+			for e := w.elem.Prev(); e != nil; e = e.Prev() {
+				it := e.Value.(*Intent)
+				if it.clt == c || (w.shared && it.shared) {
+					continue
+				}
+				path = append(path, w)
+				if it.clt == clt {
+					return true
+				}
+				if !visited[it.clt] && visit(it.clt) {
+					return true
+				}
+				path = path[:len(path)-1]
+			}
+		}
+		return false
+	}
+
+	if visit(clt) {
+		return path
+	}
+	return nil
+}
+
+/*****************************************************************************/
+
+// Victim selects the intent to be cancelled to break a deadlock: the youngest
+// one, so that the oldest requests make progress.
+func Victim(cycle []*Intent) *Intent {
+
+	victim := cycle[0]
+	for _, it := range cycle[1:] {
+		if it.seq > victim.seq {
+			victim = it
+		}
+	}
+	return victim
+}
+
+/*****************************************************************************/
@@ -5,8 +5,185 @@ It includes the following primitives:
   get: Get an integer value.
   set: Set an integer value.
   incr: Increment an integer value.
-  lock: Lock an item.
+  lock: Lock an item, with an optional timeout (e.g. "500ms").
   unlock: Unlock an item.
+  trylock: Lock an item if it is free, without waiting.
+  renew: Extend the lease of a held lock.
+  check: Check a fencing token against the current holders of a lock.
+  lockall: Lock several items (Targets) at once, all or none.
+  promote: Turn a follower into a primary server.
+  watch: Subscribe to the changes of an integer value.
+  unwatch: Cancel a subscription.
+  hello: Give a name to the connection (Arg).
+  owner: Show the holders and the waiters of a lock.
+  locks: Show the locks held or waited for by the connection.
+
+Locks are exclusive by default. Several clients can hold the same lock at the
+same time if they all request it with the "shared" mode. Lock intents are
+queued in FIFO order, so that a client waiting for an exclusive lock is not
+starved by shared lock holders.
+
+A lock is normally held until it is unlocked or the client disconnects. When
+a lease duration is given with the lock request (e.g. "Lease":"10s"), the lock
+is also released if the lease is not renewed in time, and granted to the next
+waiting clients.
+
+Each time a lock is granted, a fencing token is returned in the value of the
+reply. Tokens are strictly increasing, so a storage layer can reject the
+writes of a client whose lock has been revoked since. They can also be
+validated with the check operation. They keep increasing across a restart only
+if the server persists its state (see below): a server without persistence
+directory starts again from the lowest tokens.
+
+Each query can carry an optional Id chosen by the client. It is echoed in the
+corresponding reply, including deferred lock grants and errors, so that a
+client pipelining its queries can match the replies.
+
+The lockall operation queues the lock intents on all its targets at once, and
+replies only when all the locks are granted, with the fencing tokens in the
+order of the targets. Since the intents of two lockall operations are always
+queued in the same order, they cannot deadlock each other.
+
+Clients holding some locks while waiting for others can still deadlock. Each
+time a lock intent is queued, the server looks for a cycle in the wait-for
+graph. The youngest intent of the cycle is then cancelled, and its client
+gets a "Deadlock detected" error. The number of detected deadlocks is reported
+by the monitoring server.
+
+The owner and locks operations return the names of the holders or of the held
+locks in the Value, and the details of the lock intents (client, lock, mode,
+held or waiting, fencing token) in the Info of the reply, in queue order. The
+clients are shown with the name given by the hello operation, or with their
+address by default.
+
+The operators can connect to a separate administration port (Options.AdminAddr)
+to recover from misbehaving clients. The clients operation lists the
+connections, with their id, address, connection time, number of queries and
+held locks, in the Clients of the reply. The release operation forcibly
+releases a lock, and grants it to the next waiter: its holders receive a
+notification with the "revoked" Event. The kill operation closes the
+connection whose id is given as argument, which releases its locks as for a
+normal disconnection. The promote operation is also restricted to this port.
+These operations are rejected on the other ports.
+
+The server can require the clients to authenticate (Options.AuthFile). The
+first operation of a connection must then be auth, with the user name as
+Target and the password as Arg; the other operations are rejected until it
+succeeds. The credentials file, described in auth.go, also gives the rules of
+each user: the allowed operations, and the prefix of the names they can be
+applied to. The denied operations are returned as KO replies, and counted by
+the monitoring server. The Redis clients use the AUTH command, and the HTTP
+clients the basic authentication.
+
+The client ports and the monitoring server can be protected with TLS
+(Options.TLSCert and Options.TLSKey). With a client CA (Options.TLSClientCA),
+the clients must also present a certificate signed by this CA (mutual TLS);
+the common name of the certificate is then the user name, and the auth
+operation is not needed.
+
+On SIGINT or SIGTERM, the server stops gracefully: it stops accepting
+connections, the clients waiting for a lock get a "Server shutting down"
+error (as well as the new lock requests), and the connections are closed once
+their pending replies are written, or killed after Options.ShutdownTimeout.
+A final snapshot is then written if persistence is enabled.
+
+The server can also be embedded in another program with the Server type,
+built from the Options. Start returns once the listeners are open (port 0
+picks a free port, given by Addr and MonitorAddr), and Shutdown stops the
+server gracefully within the deadline of its context. Each Server has its own
+cores, listeners, monitoring server and logger, so that several servers can
+run in the same process. MainServer is a Server stopped on SIGINT or SIGTERM.
+
+The cores never wait for a client. The replies of a connection are queued up
+to Options.ReplyQueue, and each reply must be written within
+Options.WriteTimeout: a client which does not read its replies fast enough is
+disconnected, and its locks are released. The number of such slow clients is
+reported by the monitoring server.
+
+The monitoring server exposes the metrics of the server on /metrics, in the
+Prometheus text format: the queries by operation, the errors, the connected
+clients, the held and queued lock intents, the depth of the incoming channels
+of the cores, and the histograms of the processing time of the core events and
+of the lock wait time. The cores update them with atomic operations, so a
+scrape never waits for them.
+
+The /monitoring websocket pushes the live counters every half second (see
+ResultJson): the throughput, the rates by operation, the clients, the lock
+counts, the queue depth and the most contended locks. The monitoring server
+also serves a dashboard page on /, drawing these counters from the
+websocket, e.g. http://localhost:4010/. When the authentication is enabled,
+these pages need the credentials of a user, as for the HTTP gateway.
+
+A client can watch an integer value, or all the values whose name starts with
+a prefix (with the "prefix" mode). Each successful set or incr operation on a
+watched value is then notified to the client, without query: the notification
+is a reply with the "change" Event, the name of the value as Target, and the
+new value. The subscriptions are cancelled when the client disconnects.
+
+The integer values can be persisted in a directory, so that they survive a
+restart. Each set or incr operation is first appended to a write-ahead log
+(stats.log), which is periodically compacted into a snapshot (stats.snap).
+Both files are JSON text files, described with the Record and Snapshot types.
+The log is fsynced according to the configured SyncPolicy.
+
+A second server can follow a primary server: it connects to the replication
+port of the primary, receives the ordered stream of the changes of the
+integer values, and only serves get operations. If a follower cannot persist
+a record, it stops applying the stream and reconnects, starting again with a
+full state transfer. Once promoted, it becomes a primary server. Locks are
+not replicated: they are all lost on promotion, and a new fencing epoch is
+started, so that the new fencing tokens are greater than the ones granted by
+the previous primary.
+
+The server can also accept the Redis protocol (RESP) on a second port, so that
+redis-cli and the Redis client libraries can be used. The GET, SET, INCR and
+INCRBY commands work on the integer values, and the custom LOCK key [timeout],
+TRYLOCK key and UNLOCK key commands on the locks. Errors are returned as ERR
+errors, the results of INCR and INCRBY as integers, and the other values
+(including the fencing tokens) as bulk strings. The replies are always sent in
+the order of the commands: a LOCK command waiting for the lock delays the
+replies of the next commands until it is granted, or fails.
+
+A compact binary protocol is also available on the same port. The client
+selects it by sending the BinaryMagic byte first; the messages are then
+length-prefixed frames, described in binary.go. AppendBinaryQuery and
+ReadBinaryReply implement the client side.
+
+The monitoring HTTP server also exposes a REST gateway, described in
+gateway.go, for the clients which cannot keep a connection open: the integer
+values are available as /counters/{name}, and the locks belong to sessions,
+which are closed (releasing their locks) when they are deleted or idle for
+too long.
+
+Alternatively, several servers can form a cluster, replicating both the values
+and the locks with the Raft consensus protocol. All the operations of the
+clients are appended to the replicated log by the leader, and applied by all
+the servers once a majority has stored them. The other servers reject the
+operations with a "Not leader" error, giving the address of the leader. When a
+new leader is elected, the clients of the previous one are disconnected, and
+their locks are released. The timeouts and leases only run on the leader.
+Each server stores its current term, its vote and its Raft log in the
+persistence directory (raft.state and raft.log), and fsyncs them before
+answering the other servers, so that a restarted server rebuilds its state by
+applying the log again. In cluster mode, the persistence directory only holds
+the Raft state, and primary/backup replication is not available.
+
+The Raft log is never compacted: there is no snapshot of the replicated state.
+Every operation applied by the cluster (including each lock and unlock) stays
+in memory and in raft.log for the life of the cluster, a restarted server
+replays the whole log, and a server joining with an empty directory receives
+the whole log from the leader. Cluster mode is therefore meant for clusters
+whose total number of operations is bounded: the only way to reclaim the space
+is to stop all the servers, and to start a new cluster with empty directories,
+which loses the locks and the values.
+
+The server can be split into several core shards (Options.Shards), each one
+owning the locks and the integer values whose name hashes to it, so that the
+server can use several processors. The replies to the queries of a connection
+are still delivered in order. With several shards, a lockall operation is only
+accepted if all its targets belong to the same shard, deadlocks involving
+several shards are not detected, and persistence, replication and cluster mode
+are not available.
 
 */
 package lockserver
@@ -0,0 +1,378 @@
+// This file contains the HTTP gateway, served next to the monitoring server,
+// for the clients which cannot keep a TCP connection open. The counters are
+// available without session:
+//
+//   GET  /counters/{name}            get
+//   PUT  /counters/{name}            set, the value being the request body
+//   POST /counters/{name}            incr, by the request body (1 if empty)
+//
+// The locks belong to sessions, which replace the connections: a session is
+// closed, and its locks released, when it is deleted or has been idle for
+// longer than its TTL.
+//
+//   POST   /sessions                 create a session (optional ttl parameter)
+//   PUT    /sessions/{id}            keep a session alive
+//   DELETE /sessions/{id}            close a session
+//   PUT    /sessions/{id}/locks/{name}   lock (timeout, mode and lease parameters)
+//   DELETE /sessions/{id}/locks/{name}   unlock
+//
+// The replies are the JSON replies of the TCP protocol. KO replies come with
+// the 409 status code, 403 for the denied operations, or 503 if the server
+// cannot process the operation.
+//
+// When the authentication is enabled, the requests carry the credentials of a
+// user with the basic HTTP authentication, or a client certificate, and a
+// session can only be used by the user who has created it.
+
+package lockserver
+
+import "crypto/rand"
+import "encoding/hex"
+import "encoding/json"
+import "io"
+import "net/http"
+import "strings"
+import "sync"
+import "time"
+
+/*****************************************************************************/
+
+// defaultLockTimeout is the lock timeout of the HTTP requests without timeout
+// parameter: an HTTP request cannot wait forever.
+const defaultLockTimeout = 10 * time.Second
+
+/*****************************************************************************/
+
+// Session is a client of the HTTP gateway. A session processes one request at
+// a time, so every reply of the core belongs to the current request.
+type Session struct {
+	id     string             // Random id, used in the URLs
+	ttl    time.Duration      // Maximum idle time
+	mutex  sync.Mutex         // Serializes the requests
+	timer  *time.Timer        // Expiration timer, stopped during the requests
+	closed bool               // True once the session is closed
+	out    chan *MessageReply // Reply of the current request
+	user   *User              // Owner of the session, nil without authentication
+}
+
+/*****************************************************************************/
+
+// Reply is used by the core methods to return a reply to the session
+func (s *Session) Reply(r *MessageReply) {
+
+	// Close notifications and events are not needed
+	if r.oper != OP_CLOSE && r.Event == "" {
+		s.out <- r
+	}
+}
+
+/*****************************************************************************/
+
+// String returns the id of the session
+func (s *Session) String() string {
+	return "session " + s.id
+}
+
+/*****************************************************************************/
+
+// Gateway is the HTTP gateway
+type Gateway struct {
+	router   *Router             // Core shards
+	ttl      time.Duration       // Default TTL of the sessions
+	mutex    sync.Mutex          // Protects sessions
+	sessions map[string]*Session // Open sessions, by id
+}
+
+/*****************************************************************************/
+
+// NewGateway builds a Gateway object
+func NewGateway(router *Router, ttl time.Duration) *Gateway {
+	return &Gateway{router: router, ttl: ttl, sessions: make(map[string]*Session)}
+}
+
+/*****************************************************************************/
+
+// register adds the gateway handlers to a mux
+func (gw *Gateway) register(mux *http.ServeMux) {
+
+	mux.Handle("/counters/", gw)
+	mux.Handle("/sessions", gw)
+	mux.Handle("/sessions/", gw)
+}
+
+/*****************************************************************************/
+
+// ServeHTTP dispatches the HTTP requests
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	user, ok := gw.authenticate(w, req)
+	if !ok {
+		return
+	}
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 2 && path[0] == "counters" && path[1] != "":
+		gw.serveCounter(w, req, user, path[1])
+	case len(path) == 1 && path[0] == "sessions" && req.Method == "POST":
+		gw.create(w, req, user)
+	case len(path) == 2 && path[0] == "sessions":
+		gw.serveSession(w, req, user, path[1])
+	case len(path) == 4 && path[0] == "sessions" && path[2] == "locks" && path[3] != "":
+		gw.serveLock(w, req, user, path[1], path[3])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+/*****************************************************************************/
+
+// authenticate checks the credentials of a request, if the authentication is
+// enabled: the client certificate, or the basic authentication. It returns
+// false, and replies, if they are missing or invalid.
+func (gw *Gateway) authenticate(w http.ResponseWriter, req *http.Request) (*User, bool) {
+
+	auth := gw.router.auth
+	if auth == nil {
+		return nil, true
+	}
+	if req.TLS != nil {
+		if user := auth.certUser(*req.TLS); user != nil {
+			return user, true
+		}
+	}
+	name, password, _ := req.BasicAuth()
+	if user := auth.Login(name, password); user != nil {
+		return user, true
+	}
+	auth.deny("Invalid credentials")
+	w.Header().Set("WWW-Authenticate", `Basic realm="lockserver"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return nil, false
+}
+
+/*****************************************************************************/
+
+// serveCounter implements the counter operations. A temporary session is
+// used, so that the query is processed like any other one.
+func (gw *Gateway) serveCounter(w http.ResponseWriter, req *http.Request, user *User, name string) {
+
+	m := &MessageQuery{Target: name}
+	switch req.Method {
+	case "GET":
+		m.Op = "get"
+	case "PUT", "POST":
+		body, err := io.ReadAll(io.LimitReader(req.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Op, m.Arg = "set", strings.TrimSpace(string(body))
+		if req.Method == "POST" {
+			m.Op = "incr"
+			if m.Arg == "" {
+				m.Arg = "1"
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := gw.newSession(0, user)
+	gw.router.broadcast(&MessageQuery{clt: s, oper: OP_OPEN})
+	reply := gw.query(s, m)
+	gw.router.broadcast(&MessageQuery{clt: s, oper: OP_CLOSE})
+	writeJson(w, reply)
+}
+
+/*****************************************************************************/
+
+// create opens a new session
+func (gw *Gateway) create(w http.ResponseWriter, req *http.Request, user *User) {
+
+	ttl := gw.ttl
+	if arg := req.URL.Query().Get("ttl"); arg != "" {
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	s := gw.newSession(ttl, user)
+	gw.router.broadcast(&MessageQuery{clt: s, oper: OP_OPEN})
+	gw.mutex.Lock()
+	gw.sessions[s.id] = s
+	gw.mutex.Unlock()
+	s.timer = time.AfterFunc(ttl, func() { gw.close(s) })
+
+	w.Header().Set("Location", "/sessions/"+s.id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"Session": s.id, "TTL": ttl.String()})
+}
+
+/*****************************************************************************/
+
+// serveSession keeps alive, or closes a session
+func (gw *Gateway) serveSession(w http.ResponseWriter, req *http.Request, user *User, id string) {
+
+	switch req.Method {
+	case "PUT":
+		if s := gw.acquire(id, user); s != nil {
+			gw.release(s)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case "DELETE":
+		if s := gw.acquire(id, user); s != nil {
+			// The timer is stopped, so the session cannot be acquired again
+			s.mutex.Unlock()
+			gw.close(s)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+/*****************************************************************************/
+
+// serveLock implements the lock operations of a session
+func (gw *Gateway) serveLock(w http.ResponseWriter, req *http.Request, user *User, id string, name string) {
+
+	params := req.URL.Query()
+	m := &MessageQuery{Target: name, Mode: params.Get("mode")}
+	switch req.Method {
+	case "PUT":
+		m.Op, m.Arg, m.Lease = "lock", params.Get("timeout"), params.Get("lease")
+		if m.Arg == "" {
+			m.Arg = defaultLockTimeout.String()
+		}
+	case "DELETE":
+		m.Op = "unlock"
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := gw.acquire(id, user)
+	if s == nil {
+		http.NotFound(w, req)
+		return
+	}
+	reply := gw.query(s, m)
+	gw.release(s)
+	writeJson(w, reply)
+}
+
+/*****************************************************************************/
+
+// newSession builds a session with a random id
+func (gw *Gateway) newSession(ttl time.Duration, user *User) *Session {
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return &Session{id: hex.EncodeToString(b), ttl: ttl, out: make(chan *MessageReply, 1), user: user}
+}
+
+/*****************************************************************************/
+
+// acquire finds a session of a user, and suspends its expiration until it is
+// released. It returns nil if the session does not exist, or is expiring.
+func (gw *Gateway) acquire(id string, user *User) *Session {
+
+	gw.mutex.Lock()
+	s := gw.sessions[id]
+	gw.mutex.Unlock()
+	if s == nil || s.user != user {
+		return nil
+	}
+	s.mutex.Lock()
+	if s.closed || !s.timer.Stop() {
+		s.mutex.Unlock()
+		return nil
+	}
+	return s
+}
+
+/*****************************************************************************/
+
+// release restarts the expiration timer of an acquired session
+func (gw *Gateway) release(s *Session) {
+
+	s.timer.Reset(s.ttl)
+	s.mutex.Unlock()
+}
+
+/*****************************************************************************/
+
+// close closes an expired or deleted session: its locks are released
+func (gw *Gateway) close(s *Session) {
+
+	gw.mutex.Lock()
+	delete(gw.sessions, s.id)
+	gw.mutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		gw.router.broadcast(&MessageQuery{clt: s, oper: OP_CLOSE})
+	}
+}
+
+/*****************************************************************************/
+
+// closeAll closes all the sessions, when the server stops
+func (gw *Gateway) closeAll() {
+
+	gw.mutex.Lock()
+	var sessions []*Session
+	for _, s := range gw.sessions {
+		sessions = append(sessions, s)
+	}
+	gw.mutex.Unlock()
+
+	// The expiration timers find the sessions closed
+	for _, s := range sessions {
+		gw.close(s)
+	}
+}
+
+/*****************************************************************************/
+
+// query sends a query to the core, and waits for its reply. The query is
+// denied if the user of the session is not allowed to run it.
+func (gw *Gateway) query(s *Session, m *MessageQuery) *MessageReply {
+
+	m.clt, m.oper = s, Service[m.Op]
+	if s.user != nil && !s.user.allows(m) {
+		return gw.router.auth.deny("Permission denied")
+	}
+	gw.router.route(m)
+	return <-s.out
+}
+
+/*****************************************************************************/
+
+// writeJson writes a reply, with the HTTP status code matching its status
+func writeJson(w http.ResponseWriter, reply *MessageReply) {
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case reply.Status == "OK":
+	case reply.Error == "Permission denied":
+		w.WriteHeader(http.StatusForbidden)
+	case reply.Error == "Not leader" || reply.Error == "Read-only follower":
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+/*****************************************************************************/
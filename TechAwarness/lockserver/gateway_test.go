@@ -0,0 +1,82 @@
+package lockserver
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func TestGateway(t *testing.T) {
+
+	mux := http.NewServeMux()
+	NewGateway(startShards(2), time.Hour).register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// request sends an HTTP request, and checks the status code of the reply
+	request := func(method string, path string, body string, code int) *MessageReply {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("%s %s: expected %d, got %d", method, path, code, resp.StatusCode)
+		}
+		reply := &MessageReply{}
+		json.NewDecoder(resp.Body).Decode(reply)
+		return reply
+	}
+	session := func(ttl string) string {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/sessions?ttl="+ttl, "", nil)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatal("Cannot create session", err)
+		}
+		defer resp.Body.Close()
+		m := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&m)
+		return "/sessions/" + m["Session"]
+	}
+
+	// Counters
+	request("PUT", "/counters/toto", "10", 200)
+	if r := request("POST", "/counters/toto", "5", 200); r.Value != "15" {
+		t.Error("Wrong value", r.Value)
+	}
+	request("POST", "/counters/toto", "", 200)
+	if r := request("GET", "/counters/toto", "", 200); r.Value != "16" {
+		t.Error("Wrong value", r.Value)
+	}
+	if r := request("PUT", "/counters/toto", "abc", 409); r.Error != "Invalid number" {
+		t.Error("Wrong error", r.Error)
+	}
+	request("GET", "/counters/", "", 404)
+
+	// Locks: the lock of an expired session is released
+	s1, s2 := session("1h"), session("100ms")
+	request("PUT", s2+"/locks/lk", "", 200)
+	if r := request("PUT", s1+"/locks/lk?timeout=20ms", "", 409); r.Error != "Lock timeout" {
+		t.Error("Wrong error", r.Error)
+	}
+	if r := request("PUT", s1+"/locks/lk?timeout=5s", "", 200); r.Value == "" {
+		t.Error("Missing fencing token")
+	}
+	request("PUT", s2, "", 404)
+	request("DELETE", s1+"/locks/lk", "", 200)
+	request("DELETE", s1+"/locks/lk", "", 409)
+
+	// Closing a session
+	request("PUT", s1+"/locks/lk", "", 200)
+	request("DELETE", s1, "", 204)
+	request("PUT", s1, "", 404)
+	s3 := session("1h")
+	request("PUT", s3+"/locks/lk?timeout=1s", "", 200)
+}
+
+/*****************************************************************************/
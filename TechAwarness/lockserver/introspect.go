@@ -0,0 +1,101 @@
+// This file contains the introspection operations, showing the state of the
+// locks to the clients.
+
+package lockserver
+
+import "strings"
+
+/*****************************************************************************/
+
+// IntentInfo describes a lock intent, in the replies of the introspection
+// operations
+type IntentInfo struct {
+	Client string `json:",omitempty"` // Name of the client (owner operation)
+	Name   string `json:",omitempty"` // Name of the lock (locks operation)
+	Mode   string // exclusive or shared
+	Held   bool   // True if the lock is held, false if it is waited for
+	Token  string `json:",omitempty"` // Fencing token of a held lock
+}
+
+/*****************************************************************************/
+
+// intentInfo describes a lock intent
+func intentInfo(it *Intent) IntentInfo {
+
+	info := IntentInfo{Mode: "exclusive", Held: it.held()}
+	if it.shared {
+		info.Mode = "shared"
+	}
+	if info.Held {
+		info.Token = it.fencingToken()
+	}
+	return info
+}
+
+/*****************************************************************************/
+
+// name returns the name given by a client, or its default description
+func (core *Core) name(clt Replier) string {
+
+	if name, ok := core.names[clt]; ok {
+		return name
+	}
+	return describe(clt)
+}
+
+/*****************************************************************************/
+
+// handleHello records the name of a client, shown by the introspection
+// operations instead of its address
+func (core *Core) handleHello(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Hello", query.Arg)
+	}
+	if query.Arg == "" {
+		query.reply(&MessageReply{Status: "KO", Error: "Missing name"})
+		return
+	}
+	core.names[query.clt] = query.Arg
+	query.reply(&MessageReply{Status: "OK"})
+}
+
+/*****************************************************************************/
+
+// handleOwner returns the holders of a lock in the value, and the holders
+// followed by the waiters, in queue order, in the info.
+func (core *Core) handleOwner(query *MessageQuery) {
+
+	holders := []string{}
+	infos := []IntentInfo{}
+	for _, it := range core.locks.Queue(query.Target) {
+		info := intentInfo(it)
+		info.Client = core.name(it.clt)
+		if info.Held {
+			holders = append(holders, info.Client)
+		}
+		infos = append(infos, info)
+	}
+	query.reply(&MessageReply{Status: "OK", Value: strings.Join(holders, ","), Info: infos})
+}
+
+/*****************************************************************************/
+
+// handleLocks returns the locks held by the client in the value, and all its
+// lock intents, from the oldest to the youngest, in the info.
+func (core *Core) handleLocks(query *MessageQuery) {
+
+	held := []string{}
+	infos := []IntentInfo{}
+	for _, it := range core.locks.Intents(query.clt) {
+		info := intentInfo(it)
+		info.Name = it.name
+		if info.Held {
+			held = append(held, it.name)
+		}
+		infos = append(infos, info)
+	}
+	query.reply(&MessageReply{Status: "OK", Value: strings.Join(held, ","), Info: infos})
+}
+
+/*****************************************************************************/
@@ -0,0 +1,98 @@
+package lockserver
+
+import "testing"
+
+/*****************************************************************************/
+
+func TestIntrospection(t *testing.T) {
+
+	core := startCore()
+	c0, c1, c2 := newReplier(core), newReplier(core), newReplier(core)
+
+	c0.send("hello", "", "job-0")
+	c0.expect(t, "OK")
+	c1.send("hello", "", "")
+	c1.expect(t, "KO")
+	c1.send("hello", "", "job-1")
+	c1.expect(t, "OK")
+
+	c0.send("lock", "toto", "")
+	c0.expect(t, "OK")
+	c1.send("lock", "toto", "")
+	c2.sendMode("lock", "toto", "shared")
+
+	// Holder and waiters of a lock, in queue order
+	c0.send("owner", "toto", "")
+	m := c0.expect(t, "OK")
+	if m.Value != "job-0" || len(m.Info) != 3 {
+		t.Fatal("Wrong owner reply", m)
+	}
+	if i := m.Info[0]; i.Client != "job-0" || !i.Held || i.Token == "" || i.Mode != "exclusive" {
+		t.Error("Wrong holder", i)
+	}
+	if i := m.Info[1]; i.Client != "job-1" || i.Held || i.Token != "" {
+		t.Error("Wrong waiter", i)
+	}
+	if i := m.Info[2]; i.Client != describe(c2) || i.Held || i.Mode != "shared" {
+		t.Error("Wrong waiter", i)
+	}
+	c0.send("trylock", "toto", "")
+	c0.expect(t, "OK")
+	c2.send("trylock", "toto", "")
+	if m := c2.expect(t, "KO"); m.Value != "job-0" {
+		t.Error("Wrong holders", m.Value)
+	}
+
+	// Locks of the client
+	c0.send("lock", "titi", "")
+	c0.expect(t, "OK")
+	c0.send("locks", "", "")
+	if m := c0.expect(t, "OK"); m.Value != "toto,titi" || len(m.Info) != 2 || m.Info[1].Name != "titi" {
+		t.Error("Wrong locks reply", m)
+	}
+	c1.send("locks", "", "")
+	if m := c1.expect(t, "OK"); m.Value != "" || len(m.Info) != 1 || m.Info[0].Held {
+		t.Error("Wrong locks reply", m)
+	}
+
+	// Names are forgotten with the client
+	c0.close()
+	c1.expect(t, "OK")
+	c1.send("owner", "toto", "")
+	if m := c1.expect(t, "OK"); m.Value != "job-1" {
+		t.Error("Wrong owner", m.Value)
+	}
+	if _, ok := core.names[c0]; ok {
+		t.Error("Name not forgotten")
+	}
+}
+
+/*****************************************************************************/
+
+func TestIntrospectionShards(t *testing.T) {
+
+	router := startShards(4)
+	r := &replier{out: make(chan *MessageReply, 64)}
+	router.broadcast(&MessageQuery{clt: r, oper: OP_OPEN})
+	query := func(op string, target string, arg string) *MessageReply {
+		router.route(&MessageQuery{Op: op, Target: target, Arg: arg, oper: Service[op], clt: r})
+		return r.expect(t, "OK")
+	}
+
+	// The name and the locks of a client span all the shards
+	query("hello", "", "job")
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for _, name := range names {
+		query("lock", name, "")
+	}
+	if m := query("locks", "", ""); len(m.Info) != len(names) {
+		t.Error("Wrong locks reply", m)
+	}
+	for _, name := range names {
+		if m := query("owner", name, ""); m.Value != "job" {
+			t.Error("Wrong owner", m.Value)
+		}
+	}
+}
+
+/*****************************************************************************/
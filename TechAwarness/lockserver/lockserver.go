@@ -1,18 +1,21 @@
 package lockserver
 
+import "bufio"
+import "crypto/tls"
+import "fmt"
 import "log"
 import "net"
 import "io"
 import "encoding/json"
+import "errors"
 import "os"
 import "strconv"
+import "strings"
 import "os/signal"
 import "sync/atomic"
-
-/*****************************************************************************/
-
-const channelSize = 16
-const verbose = false
+import "syscall"
+import "context"
+import "time"
 
 /*****************************************************************************/
 
@@ -28,67 +31,212 @@ const (
 	OP_GET
 	OP_SET
 	OP_INCR
+	OP_TRYLOCK
+	OP_RENEW
+	OP_CHECK
+	OP_LOCKALL
+	OP_TIMEOUT
+	OP_EXPIRE
+	OP_SYNC
+	OP_SNAPSHOT
+	OP_REPLICA
+	OP_APPLY
+	OP_PROMOTE
+	OP_DETACH
+	OP_COMMIT
+	OP_ROLE
+	OP_WATCH
+	OP_UNWATCH
+	OP_HELLO
+	OP_OWNER
+	OP_LOCKS
+	OP_CLIENTS
+	OP_RELEASE
+	OP_KILL
+	OP_AUTH
+	OP_SHUTDOWN
+	OP_CONTENTION
 )
 
 // Service is a map to convert an operation name into an enumerate
 var Service = map[string]Operation{
-	"lock":   OP_LOCK,
-	"unlock": OP_UNLOCK,
-	"get":    OP_GET,
-	"set":    OP_SET,
-	"incr":   OP_INCR,
+	"lock":    OP_LOCK,
+	"unlock":  OP_UNLOCK,
+	"get":     OP_GET,
+	"set":     OP_SET,
+	"incr":    OP_INCR,
+	"trylock": OP_TRYLOCK,
+	"renew":   OP_RENEW,
+	"check":   OP_CHECK,
+	"lockall": OP_LOCKALL,
+	"promote": OP_PROMOTE,
+	"watch":   OP_WATCH,
+	"unwatch": OP_UNWATCH,
+	"hello":   OP_HELLO,
+	"owner":   OP_OWNER,
+	"locks":   OP_LOCKS,
+	"clients": OP_CLIENTS,
+	"release": OP_RELEASE,
+	"kill":    OP_KILL,
+	"auth":    OP_AUTH,
+}
+
+// mutations lists the operations a follower cannot serve
+var mutations = map[Operation]bool{
+	OP_LOCK:    true,
+	OP_UNLOCK:  true,
+	OP_SET:     true,
+	OP_INCR:    true,
+	OP_TRYLOCK: true,
+	OP_RENEW:   true,
+	OP_CHECK:   true,
+	OP_LOCKALL: true,
+	OP_RELEASE: true,
 }
 
 /*****************************************************************************/
 
-// MessageQuery is the query message structure.
+// MessageQuery is the query message structure. The optional Id is chosen by
+// the client, and echoed in the corresponding reply.
 type MessageQuery struct {
-	Op     string
-	Target string
-	Arg    string `json:",omitempty"`
-	oper   Operation
-	clt    Replier
+	Id      string `json:",omitempty"`
+	Op      string
+	Target  string
+	Arg     string   `json:",omitempty"`
+	Mode    string   `json:",omitempty"`
+	Lease   string   `json:",omitempty"`
+	Targets []string `json:",omitempty"`
+	oper    Operation
+	clt     Replier
+	intent  *Intent
+	replica *Replica
+	record  *Record
+	renewal uint64
+	command *Command
+	role    *Role
+	seq     uint64   // Position in the queries of the connection, 0 if not ordered
+	replied bool     // True once the query has been replied
+	ordered bool     // True if a deferred reply keeps the position of the query (RESP)
+	held    bool     // True if the reply is deferred, keeping the position of the query
+	gather  *gather  // Merges the replies of the copies sent to all the shards, if any
+	admin   bool     // True for the queries of the administration listener
+	link    net.Conn // Connection to the primary of a replicated record
+	// True when the query comes from the replicated log of the cluster
+	committed bool
 }
 
-// MessageReply is the reply message structure.
+// MessageReply is the reply message structure. The notifications sent to the
+// clients without query (e.g. the changes of the watched values) have an
+// Event, and the Target they relate to. The introspection operations return
+// the details of the lock intents in Info, and the clients operation the
+// details of the connections in Clients.
 type MessageReply struct {
-	Status string
-	Error  string `json:",omitempty"`
-	Value  string `json:",omitempty"`
-	oper   Operation
+	Id      string `json:",omitempty"`
+	Status  string
+	Error   string       `json:",omitempty"`
+	Value   string       `json:",omitempty"`
+	Event   string       `json:",omitempty"`
+	Target  string       `json:",omitempty"`
+	Info    []IntentInfo `json:",omitempty"`
+	Clients []ClientInfo `json:",omitempty"`
+	oper    Operation
+	seq     uint64       // Sequence number of the query, 0 for notifications
+	skip    bool         // True if the query has no immediate reply
+	locks   []Contention // Most contended locks, for the monitoring server
+}
+
+/*****************************************************************************/
+
+// reply sends a reply to the client of a query, echoing the query id. The
+// operation is kept in the reply, for the protocols encoding it.
+func (m *MessageQuery) reply(r *MessageReply) {
+	if m.gather != nil {
+		m.replied = true
+		m.gather.add(r)
+		return
+	}
+	r.Id, r.seq, r.oper = m.Id, m.seq, m.oper
+	m.replied = true
+	m.clt.Reply(r)
+}
+
+/*****************************************************************************/
+
+// processed lets the client know an ordered query has been processed, even
+// if it has no immediate reply
+func (m *MessageQuery) processed() {
+
+	if m.seq != 0 && !m.replied && !m.held {
+		m.clt.Reply(&MessageReply{seq: m.seq, skip: true})
+	}
 }
 
 /*****************************************************************************/
 
 // Listener is the main TCP server, waiting for incoming connections
 type Listener struct {
-	lis  *net.Listener // TCP listener
-	core *Core         // Core goroutine
+	lis    net.Listener // TCP listener
+	router *Router      // Core shards
+	resp   bool         // True for the Redis protocol, false for JSON
+	admin  bool         // True for the administration listener
+	config *tls.Config  // TLS configuration, nil for plain TCP
 }
 
 /*****************************************************************************/
 
-// Listen starts the TCP server loop, waiting for incoming connections
-func (ln *Listener) Listen(t string, addr string) {
+// Listen opens the TCP server, and starts the loop waiting for incoming
+// connections
+func (ln *Listener) Listen(t string, addr string) error {
 
 	// Declare TCP listening server
 	lis, err := net.Listen(t, addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	ln.router.log.Printf("Listening to %s-%s\n", t, lis.Addr())
+	ln.lis = lis
+	go ln.Serve(lis)
+	return nil
+}
+
+/*****************************************************************************/
+
+// Close stops accepting the incoming connections
+func (ln *Listener) Close() {
+	ln.lis.Close()
+}
+
+/*****************************************************************************/
+
+// Serve accepts the incoming connections of an existing listener, until it
+// is closed.
+func (ln *Listener) Serve(lis net.Listener) {
+
+	if ln.config != nil {
+		lis = tls.NewListener(lis, ln.config)
 	}
-	log.Printf("Listening to %s-%s\n", t, addr)
 
 	// Main loop
 	for {
 		// Accept incoming connection
 		c, err := lis.Accept()
-		if err != nil {
-			log.Println(err)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			ln.router.log.Println(err)
 		} else {
 			// Connection accepted, create client and spawn associated goroutines
-			clt := NewClient(c, ln.core)
-			go clt.jsonIn()
-			go clt.jsonOut()
+			if ln.resp {
+				clt := NewRespClient(c, ln.router)
+				ln.router.track(clt)
+				go clt.respIn()
+				go clt.respOut()
+			} else {
+				clt := NewClient(c, ln.router)
+				clt.admin = ln.admin
+				ln.router.track(clt)
+				go clt.serve()
+			}
 		}
 	}
 }
@@ -97,85 +245,166 @@ func (ln *Listener) Listen(t string, addr string) {
 
 // Client represents a client connection
 type Client struct {
-	con     net.Conn           // TCP connection
-	core    *Core              // Shortcut to the core goroutine
-	coreOut chan *MessageReply // Reply channel (to be used by the core)
+	con      net.Conn           // TCP connection
+	reader   *bufio.Reader      // Buffered input of the connection
+	router   *Router            // Shortcut to the core shards
+	coreOut  chan *MessageReply // Reply channel (to be used by the core)
+	id       uint64             // Connection id
+	since    time.Time          // Connection time
+	commands int64              // Number of queries received
+	admin    bool               // True if connected to the administration listener
+	user     *User              // Authenticated user, nil until the auth operation
+	draining int32              // Set to stop reading the queries, at shutdown
+	slow     int32              // Set once disconnected as a slow consumer
 }
 
 /*****************************************************************************/
 
 // NewClient construct a Client structure
-func NewClient(con net.Conn, core *Core) (clt *Client) {
-	channel := make(chan *MessageReply, channelSize)
-	return &Client{con: con, core: core, coreOut: channel}
+func NewClient(con net.Conn, router *Router) (clt *Client) {
+	channel := router.newQueue()
+	return &Client{con: con, reader: bufio.NewReader(con), router: router, coreOut: channel, id: router.nextId(), since: time.Now()}
+}
+
+/*****************************************************************************/
+
+// serve detects the protocol of the client with its first byte, and spawns
+// the corresponding goroutines: binary if it is BinaryMagic, JSON otherwise.
+func (clt *Client) serve() {
+
+	// Identify the client by its certificate, if any
+	if auth := clt.router.auth; auth != nil {
+		clt.user = certUser(clt.con, auth)
+	}
+	if b, err := clt.reader.Peek(1); err == nil && b[0] == BinaryMagic {
+		clt.reader.Discard(1)
+		go clt.binOut()
+		clt.binIn()
+		return
+	}
+	go clt.jsonOut()
+	clt.jsonIn()
+}
+
+/*****************************************************************************/
+
+// String returns the remote address of the client
+func (clt *Client) String() string {
+	return clt.con.RemoteAddr().String()
 }
 
 /*****************************************************************************/
 
-// Reply is used by the core methods to return a reply to the client
+// Reply is used by the core methods to return a reply to the client. It
+// never blocks: a client which does not read its replies is disconnected.
 func (clt *Client) Reply(r *MessageReply) {
-	clt.coreOut <- r
+	clt.router.push(clt, clt.coreOut, &clt.slow, r)
+}
+
+/*****************************************************************************/
+
+// Info describes the connection, for the administration operations
+func (clt *Client) Info() *ClientInfo {
+	return &ClientInfo{Id: clt.id, Addr: clt.String(), Since: clt.since, Commands: atomic.LoadInt64(&clt.commands)}
+}
+
+/*****************************************************************************/
+
+// Kill closes the connection. The reading goroutine then notifies the shards.
+func (clt *Client) Kill() {
+	clt.con.Close()
+}
+
+/*****************************************************************************/
+
+// Drain stops reading the queries. The connection is closed once the replies
+// of the shards are written.
+func (clt *Client) Drain() {
+
+	atomic.StoreInt32(&clt.draining, 1)
+	clt.con.SetReadDeadline(time.Now())
 }
 
 /*****************************************************************************/
 
 // jsonIn processes incoming JSON traffic from the client socket, decode it,
-// and send messages to the core.
+// and send messages to the core shards.
 func (clt *Client) jsonIn() {
 
-	// Be sure the core is notified when connection is closed
-	defer func() { clt.core.in <- &MessageQuery{clt: clt, oper: OP_CLOSE} }()
+	// Be sure the shards are notified when connection is closed
+	defer clt.router.broadcast(&MessageQuery{clt: clt, oper: OP_CLOSE})
 
 	// Declare a JSON decoder
-	decoder := json.NewDecoder(clt.con)
-	clt.core.in <- &MessageQuery{clt: clt, oper: OP_OPEN}
+	decoder := json.NewDecoder(clt.reader)
+	clt.router.broadcast(&MessageQuery{clt: clt, oper: OP_OPEN})
+
+	// The queries are numbered when they are processed by several shards,
+	// or answered without the core, so that the replies can be reordered
+	ordered := len(clt.router.shards) > 1 || clt.router.auth != nil
+	seq := uint64(0)
 
 	for {
 
 		// Read an incoming message and decode it
-		m := &MessageQuery{clt: clt}
-		if err := decoder.Decode(m); err == io.EOF {
+		m := &MessageQuery{clt: clt, admin: clt.admin}
+		if err := decoder.Decode(m); err == io.EOF || atomic.LoadInt32(&clt.draining) != 0 {
 			break
 		} else if err != nil {
 			// Decoding error: notify the core, close the connection
-			clt.core.in <- &MessageQuery{clt: clt, oper: OP_NONE}
+			m = &MessageQuery{clt: clt, oper: OP_NONE}
+			if ordered {
+				seq++
+				m.seq = seq
+			}
+			clt.router.shards[0].in <- m
 			break
 		}
 
-		// Convert operation code and forward to the core
+		// Convert operation code and forward to the shard of the target
+		atomic.AddInt64(&clt.commands, 1)
 		m.oper = Service[m.Op]
-		clt.core.in <- m
+		if ordered {
+			seq++
+			m.seq = seq
+		}
+		if auth := clt.router.auth; auth != nil {
+			if reply := auth.authorize(&clt.user, m); reply != nil {
+				m.reply(reply)
+				continue
+			}
+		}
+		clt.router.route(m)
 	}
 }
 
 /*****************************************************************************/
 
 // jsonOut is waiting for outgoing traffic from the core, encode it in JSON
-// messages, and write it to the client socket.
+// messages, and write it to the client socket. The replies of the ordered
+// queries are written in the order of the queries; the notifications (e.g.
+// deferred lock grants) are written immediately.
 func (clt *Client) jsonOut() {
 
 	// Be sure the connection is closed in the end
+	defer clt.router.untrack(clt)
 	defer clt.con.Close()
 
 	// Declare a JSON encoder
 	encoder := json.NewEncoder(clt.con)
 
-	// Wait for outgoing messages from the core
+	// Wait for outgoing messages from the core shards
 	end := false
-	for reply := range clt.coreOut {
-		// Check closing connection notification
-		if reply.oper == OP_CLOSE {
-			break
-		}
+	clt.router.deliver(clt.coreOut, func(reply *MessageReply) {
 		// Ignore all messages after an encoding error
 		if !end {
 			// Encode a JSON message, and write it to the socket
+			clt.router.deadline(clt.con)
 			if err := encoder.Encode(reply); err != nil {
-				log.Println("Error ", err)
+				clt.router.writeFailed(clt, &clt.slow, err)
 				end = true
 			}
 		}
-	}
+	}, nil)
 }
 
 /*****************************************************************************/
@@ -183,61 +412,174 @@ func (clt *Client) jsonOut() {
 // Core is the structure representing the core goroutine, responsible on the
 // logic of the application.
 type Core struct {
-	in    chan *MessageQuery // Incoming channel
-	locks *LockArea          // Lock management data structure
-	stats map[string]int64   // Key/value data structure
-	count int64              // Command counter
+	in        chan *MessageQuery // Incoming channel
+	locks     *LockArea          // Lock management data structure
+	stats     map[string]int64   // Key/value data structure
+	count     int64              // Command counter
+	deadlocks int64              // Deadlock counter
+	store     *Store             // Persistence layer, nil if disabled
+	replicas  map[*Replica]bool  // Connected followers
+	follower  *Follower          // Replication from the primary, nil if primary
+	watches   *WatchArea         // Subscriptions to the value changes
+	names     map[Replier]string // Names given by the clients
+	cluster   *Cluster           // Cluster state, nil if not in cluster mode
+	stopping  bool               // True once the shutdown has started
+	done      chan bool          // Closed to stop the core goroutine
+	exited    chan bool          // Closed when the core goroutine has stopped
+	log       *log.Logger        // Logger of the server
+	verbose   bool               // True to log every query
+	metrics   *coreMetrics       // Metrics, read by the monitoring server
 }
 
 /*****************************************************************************/
 
 // NewCore builds a Core object
-func NewCore() *Core {
-	return &Core{
-		in:    make(chan *MessageQuery, channelSize*128),
-		locks: NewLockArea(),
-		stats: make(map[string]int64),
+func NewCore(opts *Options) *Core {
+
+	core := &Core{
+		in:       make(chan *MessageQuery, opts.ChannelSize*128),
+		locks:    NewLockArea(),
+		watches:  NewWatchArea(),
+		names:    make(map[Replier]string),
+		stats:    make(map[string]int64),
+		replicas: make(map[*Replica]bool),
+		done:     make(chan bool),
+		exited:   make(chan bool),
+		log:      opts.logger(),
+		verbose:  opts.Verbose,
+		metrics:  newCoreMetrics(),
 	}
+	core.locks.waits = core.metrics.waits
+	return core
 }
 
 /*****************************************************************************/
 
-// main is the main event loop of the Core goroutine
+// main is the main event loop of the Core goroutine, until it is stopped
 func (core *Core) main() {
 
-	// Dequeue incoming events
-	for m := range core.in {
-
-		// Dispatch event to related function
-		switch m.oper {
-		case OP_OPEN:
-			core.handleOpen(m)
-		case OP_CLOSE:
-			core.handleClose(m)
-		case OP_LOCK:
-			core.handleLock(m)
-		case OP_UNLOCK:
-			core.handleUnlock(m)
-		case OP_GET:
-			core.handleGet(m)
-		case OP_SET:
-			core.handleSet(m)
-		case OP_INCR:
-			core.handleIncr(m)
+	// Dequeue incoming events. The followers are disconnected when the core
+	// is stopped.
+	defer close(core.exited)
+	defer func() {
+		for rep := range core.replicas {
+			core.detach(rep)
+		}
+	}()
+	for {
+		var m *MessageQuery
+		select {
+		case m = <-core.in:
+		case <-core.done:
+			return
+		}
+
+		start := time.Now()
+		switch {
+		case adminOps[m.oper] && !m.admin && !m.committed:
+			// The administration operations need a privileged connection
+			m.reply(&MessageReply{Status: "KO", Error: "Permission denied"})
+		case core.stopping && !m.committed && (m.oper == OP_LOCK || m.oper == OP_LOCKALL):
+			// The clients cannot wait for a lock anymore
+			m.reply(&MessageReply{Status: "KO", Error: "Server shutting down"})
+		case core.follower != nil && mutations[m.oper]:
+			// A follower only serves read-only operations
+			m.reply(&MessageReply{Status: "KO", Error: "Read-only follower"})
+		case core.cluster != nil && !m.committed && core.intercept(m):
+			// In cluster mode, the events are applied once committed
 		default:
-			m.clt.Reply(&MessageReply{Status: "KO", Error: "Unknown operation"})
+			core.dispatch(m)
 		}
+
+		m.processed()
+		core.record(m, start)
 		atomic.AddInt64(&core.count, 1)
 	}
 }
 
 /*****************************************************************************/
 
+// dispatch calls the handler of an event
+func (core *Core) dispatch(m *MessageQuery) {
+
+	switch m.oper {
+	case OP_OPEN:
+		core.handleOpen(m)
+	case OP_CLOSE:
+		core.handleClose(m)
+	case OP_LOCK:
+		core.handleLock(m)
+	case OP_UNLOCK:
+		core.handleUnlock(m)
+	case OP_GET:
+		core.handleGet(m)
+	case OP_SET:
+		core.handleSet(m)
+	case OP_INCR:
+		core.handleIncr(m)
+	case OP_TRYLOCK:
+		core.handleTrylock(m)
+	case OP_RENEW:
+		core.handleRenew(m)
+	case OP_CHECK:
+		core.handleCheck(m)
+	case OP_LOCKALL:
+		core.handleLockall(m)
+	case OP_TIMEOUT:
+		core.handleTimeout(m)
+	case OP_EXPIRE:
+		core.handleExpire(m)
+	case OP_SYNC:
+		core.handleSync(m)
+	case OP_SNAPSHOT:
+		core.handleSnapshot(m)
+	case OP_REPLICA:
+		core.handleReplica(m)
+	case OP_APPLY:
+		core.handleApply(m)
+	case OP_PROMOTE:
+		core.handlePromote(m)
+	case OP_DETACH:
+		core.handleDetach(m)
+	case OP_COMMIT:
+		core.handleCommit(m)
+	case OP_ROLE:
+		core.handleRole(m)
+	case OP_WATCH:
+		core.handleWatch(m)
+	case OP_UNWATCH:
+		core.handleUnwatch(m)
+	case OP_HELLO:
+		core.handleHello(m)
+	case OP_OWNER:
+		core.handleOwner(m)
+	case OP_LOCKS:
+		core.handleLocks(m)
+	case OP_CLIENTS:
+		core.handleClients(m)
+	case OP_RELEASE:
+		core.handleRelease(m)
+	case OP_KILL:
+		core.handleKill(m)
+	case OP_AUTH:
+		// The credentials are checked by the connections
+		m.reply(&MessageReply{Status: "KO", Error: "Authentication disabled"})
+	case OP_SHUTDOWN:
+		core.handleShutdown(m)
+	case OP_CONTENTION:
+		core.handleContention(m)
+	default:
+		m.reply(&MessageReply{Status: "KO", Error: "Unknown operation"})
+	}
+}
+
+/*****************************************************************************/
+
 // handleOpen handles open connection notifications
 func (core *Core) handleOpen(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Opening connection")
+	if core.verbose {
+		core.log.Println("Opening connection")
 	}
 	core.locks.AddClient(query.clt)
 }
@@ -247,61 +589,327 @@ func (core *Core) handleOpen(query *MessageQuery) {
 // handleClose handles close connection notification
 func (core *Core) handleClose(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Closing connection")
+	if core.verbose {
+		core.log.Println("Closing connection")
 	}
 	// Remove client from all data structures.
 	// All locks will be released.
 	toBeNotified := core.locks.RemoveClient(query.clt)
+	core.watches.RemoveClient(query.clt)
+	delete(core.names, query.clt)
 
 	// Send reply
 	query.clt.Reply(&MessageReply{oper: OP_CLOSE})
 
 	// Forward replies to any clients for which the locks have been regranted
-	for _, c := range toBeNotified {
-		c.Reply(&MessageReply{Status: "OK"})
-	}
+	core.grant(toBeNotified)
 }
 
 /*****************************************************************************/
 
-// handleLock manages locking operations
+// handleLock manages locking operations. The lock is exclusive, unless the
+// shared mode is requested. An optional timeout can be given as a duration in
+// the argument (e.g. "500ms"): if the lock is not granted in time, the lock
+// intent is cancelled and an error is returned. An optional lease duration can
+// also be given: the lock is then automatically released if it is not renewed
+// in time.
 func (core *Core) handleLock(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Locking", query.Target)
+	if core.verbose {
+		core.log.Println("Locking", query.Target, query.Mode)
+	}
+
+	// Parse the lock mode, and the optional timeout and lease
+	shared, timeout, lease, ok := parseLockArgs(query)
+	if !ok {
+		return
+	}
+
+	// The locks of a pending multi-lock or ordered request cannot be
+	// requested again, and a lock cannot be requested in another mode
+	if it := core.locks.Intent(query.clt, query.Target); it != nil {
+		switch {
+		case !it.held() && (it.group != nil || it.reply != 0):
+			query.reply(&MessageReply{Status: "KO", Error: "Lock already requested"})
+			return
+		case it.shared != shared:
+			query.reply(&MessageReply{Status: "KO", Error: "Already locked in another mode"})
+			return
+		}
 	}
 
 	// Try to add the lock
-	if core.locks.Add(query.clt, query.Target) {
+	granted := core.locks.AddMode(query.clt, query.Target, shared)
+	intent := core.locks.Intent(query.clt, query.Target)
+	if !granted && intent.id == "" {
+		// Keep the request id for the deferred reply
+		intent.id = query.Id
+	}
+	if !granted && query.ordered {
+		// The deferred reply takes the position of the request
+		intent.reply, query.held = query.seq, true
+	}
+	if lease != 0 {
+		intent.lease = lease
+	}
+	if granted {
 		// Only reply if the lock has been granted
-		query.clt.Reply(&MessageReply{Status: "OK"})
+		core.arm(intent)
+		query.reply(&MessageReply{Status: "OK", Value: intent.fencingToken()})
+		return
+	}
+
+	// The client is queued: arm the timer, and check for deadlocks
+	if query.Arg != "" {
+		intent.timer = core.schedule(timeout, &MessageQuery{Id: query.Id, oper: OP_TIMEOUT, clt: query.clt, intent: intent})
+	}
+	core.detect(query, intent)
+}
+
+/*****************************************************************************/
+
+// handleTrylock manages non blocking locking operations. The lock is granted
+// if it can be granted immediately, otherwise the current holders are
+// returned, and the client is not queued.
+func (core *Core) handleTrylock(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Trying to lock", query.Target, query.Mode)
+	}
+
+	// Parse the lock mode
+	shared, ok := parseMode(query.Mode)
+	if !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid lock mode"})
+		return
+	}
+
+	// Check whether the lock can be granted without waiting
+	it := core.locks.Intent(query.clt, query.Target)
+	if (it != nil && !it.held()) || (it == nil && !core.locks.Grantable(query.Target, shared)) {
+		holders := []string{}
+		for _, h := range core.locks.Holders(query.Target) {
+			holders = append(holders, core.name(h))
+		}
+		value := strings.Join(holders, ",")
+		query.reply(&MessageReply{Status: "KO", Error: "Lock already held", Value: value})
+		return
+	}
+	if it != nil && it.shared != shared {
+		query.reply(&MessageReply{Status: "KO", Error: "Already locked in another mode"})
+		return
+	}
+
+	// Parse the optional lease
+	lease, ok := parseDuration(query.Lease)
+	if !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid lease"})
+		return
+	}
+
+	// Grant the lock
+	core.locks.AddMode(query.clt, query.Target, shared)
+	it = core.locks.Intent(query.clt, query.Target)
+	if lease != 0 {
+		it.lease = lease
+	}
+	core.arm(it)
+	query.reply(&MessageReply{Status: "OK", Value: it.fencingToken()})
+}
+
+/*****************************************************************************/
+
+// handleRenew extends the lease of a lock held by the client. The new lease
+// duration can be given in the argument, otherwise the previous one is used.
+func (core *Core) handleRenew(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Renewing", query.Target)
+	}
+
+	// Parse the optional lease
+	lease, ok := parseDuration(query.Arg)
+	if !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid lease"})
+		return
+	}
+
+	// The client must hold the lock
+	it := core.locks.Intent(query.clt, query.Target)
+	if it == nil || !it.held() {
+		query.reply(&MessageReply{Status: "KO", Error: "Cannot find this lock"})
+		return
+	}
+	if lease != 0 {
+		it.lease = lease
+	}
+	if it.lease == 0 {
+		query.reply(&MessageReply{Status: "KO", Error: "No lease on this lock"})
+		return
+	}
+
+	// Restart the lease
+	core.arm(it)
+	query.reply(&MessageReply{Status: "OK", Value: it.fencingToken()})
+}
+
+/*****************************************************************************/
+
+// handleCheck validates a fencing token (given in the argument) against the
+// current holders of a lock.
+func (core *Core) handleCheck(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Checking", query.Target)
+	}
+
+	token, err := strconv.ParseUint(query.Arg, 10, 64)
+	if err != nil {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid token"})
+	} else if !core.locks.Check(query.Target, token) {
+		query.reply(&MessageReply{Status: "KO", Error: "Stale token"})
+	} else {
+		query.reply(&MessageReply{Status: "OK"})
+	}
+}
+
+/*****************************************************************************/
+
+// handleLockall manages atomic locking operations on the list of targets. A
+// single reply is sent when all the locks are granted, with the fencing
+// tokens in the order of the targets. Mode, timeout and lease are the same as
+// for the lock operation, and apply to all the locks.
+func (core *Core) handleLockall(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Locking", query.Targets, query.Mode)
+	}
+
+	// Parse the lock mode, and the optional timeout and lease
+	shared, timeout, lease, ok := parseLockArgs(query)
+	if !ok {
+		return
+	}
+
+	// Remove duplicated targets. The client must not have requested any of
+	// these locks yet.
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, name := range query.Targets {
+		if seen[name] {
+			continue
+		}
+		if core.locks.Intent(query.clt, name) != nil {
+			query.reply(&MessageReply{Status: "KO", Error: "Lock already requested", Value: name})
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		query.reply(&MessageReply{Status: "KO", Error: "No target"})
+		return
+	}
+
+	// Queue all the intents at once
+	g, granted := core.locks.AddGroup(query.clt, names, shared)
+	g.id = query.Id
+	for _, it := range g.intents {
+		it.lease = lease
+	}
+	if granted {
+		query.reply(&MessageReply{Status: "OK", Value: core.tokens(g)})
+		return
+	}
+
+	// The client is queued: arm the timer for the whole group, and check
+	// for deadlocks
+	if query.Arg != "" {
+		g.timer = core.schedule(timeout, &MessageQuery{Id: query.Id, oper: OP_TIMEOUT, clt: query.clt, intent: g.intents[0]})
 	}
+	core.detect(query, g.intents[0])
 }
 
 /*****************************************************************************/
 
-// handleUnlock manages any unlocking operation
+// handleTimeout manages lock timeout expirations
+func (core *Core) handleTimeout(query *MessageQuery) {
+
+	// Nothing to do if the lock has been granted or the client has gone
+	var granted []*Intent
+	var ok bool
+	if g := query.intent.group; g != nil {
+		granted, ok = core.locks.CancelGroup(g)
+	} else {
+		granted, ok = core.locks.Cancel(query.intent)
+	}
+	if !ok {
+		return
+	}
+
+	if core.verbose {
+		core.log.Println("Timeout", query.intent.name)
+	}
+	query.seq = query.intent.reply
+	query.reply(&MessageReply{Status: "KO", Error: "Lock timeout"})
+
+	// Removing the intent may have unblocked other clients
+	core.grant(granted)
+}
+
+/*****************************************************************************/
+
+// handleExpire manages lease expirations. The lock is released, and granted
+// to the next clients, as for a normal unlock.
+func (core *Core) handleExpire(query *MessageQuery) {
+
+	// Nothing to do if the lock has been released, or the lease renewed
+	it := query.intent
+	if it.elem == nil || query.renewal != it.renewal {
+		return
+	}
+
+	if core.verbose {
+		core.log.Println("Lease expired", it.name)
+	}
+	granted, _ := core.locks.Remove(it.clt, it.name)
+	core.grant(granted)
+}
+
+/*****************************************************************************/
+
+// handleUnlock manages any unlocking operation. If a mode is given, it must
+// match the mode of the lock held by the client.
 func (core *Core) handleUnlock(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Unlocking", query.Target)
+	if core.verbose {
+		core.log.Println("Unlocking", query.Target)
+	}
+
+	// Check the lock mode
+	if query.Mode != "" {
+		shared, ok := parseMode(query.Mode)
+		if !ok {
+			query.reply(&MessageReply{Status: "KO", Error: "Invalid lock mode"})
+			return
+		}
+		if it := core.locks.Intent(query.clt, query.Target); it != nil && it.shared != shared {
+			query.reply(&MessageReply{Status: "KO", Error: "Lock mode mismatch"})
+			return
+		}
 	}
 
 	// Try to remove the lock
-	c, ok := core.locks.Remove(query.clt, query.Target)
+	granted, ok := core.locks.Remove(query.clt, query.Target)
 	if ok {
 		// Send reply to the client
-		reply := &MessageReply{Status: "OK"}
-		query.clt.Reply(reply)
-		if c != nil {
-			// Forward a reply to another client if the lock has been regranted
-			c.Reply(reply)
-		}
+		query.reply(&MessageReply{Status: "OK"})
+		// Forward replies to other clients if the lock has been regranted
+		core.grant(granted)
 	} else {
 		// Error: could not release the lock
 		reply := &MessageReply{Status: "KO", Error: "Cannot find this lock"}
-		query.clt.Reply(reply)
+		query.reply(reply)
 	}
 }
 
@@ -310,13 +918,13 @@ func (core *Core) handleUnlock(query *MessageQuery) {
 // handleGet implements the GET integer value operation
 func (core *Core) handleGet(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Getting", query.Target)
+	if core.verbose {
+		core.log.Println("Getting", query.Target)
 	}
 
 	// Retrieve corresponding statistic, and format the value
 	val := strconv.FormatInt(core.stats[query.Target], 10)
-	query.clt.Reply(&MessageReply{Status: "OK", Value: val})
+	query.reply(&MessageReply{Status: "OK", Value: val})
 }
 
 /*****************************************************************************/
@@ -324,20 +932,26 @@ func (core *Core) handleGet(query *MessageQuery) {
 // handleSet implements the SET integer value operation
 func (core *Core) handleSet(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Setting", query.Target)
+	if core.verbose {
+		core.log.Println("Setting", query.Target)
 	}
 	var reply *MessageReply
 
 	// Parse integer
 	if n, err := strconv.ParseInt(query.Arg, 10, 64); err != nil {
 		reply = &MessageReply{Status: "KO", Error: "Invalid number"}
+	} else if !core.persist("set", query.Target, n) {
+		reply = &MessageReply{Status: "KO", Error: "Persistence failure"}
 	} else {
 		// Update corresponding statistic
 		core.stats[query.Target] = n
+		core.replicate(&Record{Op: "set", Target: query.Target, Value: n})
 		reply = &MessageReply{Status: "OK"}
 	}
-	query.clt.Reply(reply)
+	query.reply(reply)
+	if reply.Status == "OK" {
+		core.publish(query.Target)
+	}
 }
 
 /*****************************************************************************/
@@ -345,45 +959,304 @@ func (core *Core) handleSet(query *MessageQuery) {
 // handleIncr implements the INCR integer value operation
 func (core *Core) handleIncr(query *MessageQuery) {
 
-	if verbose {
-		log.Println("Increment", query.Target)
+	if core.verbose {
+		core.log.Println("Increment", query.Target)
 	}
 	var reply *MessageReply
 
 	// Try to parse the increment
 	if n, err := strconv.ParseInt(query.Arg, 10, 64); err != nil {
 		reply = &MessageReply{Status: "KO", Error: "Invalid number"}
+	} else if !core.persist("incr", query.Target, n) {
+		reply = &MessageReply{Status: "KO", Error: "Persistence failure"}
 	} else {
 		// Update the corresponding statistic
 		core.stats[query.Target] += n
+		core.replicate(&Record{Op: "incr", Target: query.Target, Value: n})
 		val := strconv.FormatInt(core.stats[query.Target], 10)
 		reply = &MessageReply{Status: "OK", Value: val}
 	}
-	query.clt.Reply(reply)
+	query.reply(reply)
+	if reply.Status == "OK" {
+		core.publish(query.Target)
+	}
+}
+
+/*****************************************************************************/
+
+// handleSync flushes the log to the disk (periodic fsync policy)
+func (core *Core) handleSync(query *MessageQuery) {
+
+	if err := core.store.Sync(); err != nil {
+		core.log.Println("Error ", err)
+	}
+}
+
+/*****************************************************************************/
+
+// handleSnapshot writes a snapshot of the key/value data structure, and
+// compacts the log. The internal queries with a client (the final snapshot)
+// are replied once done.
+func (core *Core) handleSnapshot(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Snapshot")
+	}
+	err := core.store.Snapshot(core.stats)
+	if err != nil {
+		core.log.Println("Error ", err)
+	}
+	if query.clt != nil {
+		// Internal query of the shutdown, waiting for the final snapshot
+		if err != nil {
+			query.clt.Reply(&MessageReply{Status: "KO", Error: err.Error()})
+		} else {
+			query.clt.Reply(&MessageReply{Status: "OK"})
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// persist writes a mutation to the log before it is applied. It returns false
+// if the mutation cannot be logged, and therefore must not be applied.
+func (core *Core) persist(op string, target string, value int64) bool {
+
+	if core.store == nil {
+		return true
+	}
+	if err := core.store.Append(op, target, value); err != nil {
+		core.log.Println("Error ", err)
+		return false
+	}
+	return true
+}
+
+/*****************************************************************************/
+
+// grant notifies the clients for which locks have been granted after having
+// been queued.
+func (core *Core) grant(intents []*Intent) {
+
+	for _, it := range intents {
+		if g := it.group; g != nil {
+			// A group is notified once, when all its locks are granted
+			if g.pending == 0 && !g.done {
+				core.notify(g)
+			}
+			continue
+		}
+		core.arm(it)
+		it.clt.Reply(&MessageReply{Id: it.id, Status: "OK", Value: it.fencingToken(), seq: it.reply})
+	}
+}
+
+/*****************************************************************************/
+
+// detect checks whether the lock intent queued by a query creates a
+// deadlock. The youngest intent of each cycle is cancelled, and its client
+// gets an error.
+func (core *Core) detect(query *MessageQuery, intent *Intent) {
+
+	for {
+		cycle := core.locks.Deadlock(query.clt)
+		if cycle == nil {
+			return
+		}
+		atomic.AddInt64(&core.deadlocks, 1)
+
+		// Cancel the victim, or its whole group
+		victim := Victim(cycle)
+		if core.verbose {
+			core.log.Println("Deadlock detected", victim.name)
+		}
+		var granted []*Intent
+		id := victim.id
+		if g := victim.group; g != nil {
+			granted, _ = core.locks.CancelGroup(g)
+			id = g.id
+		} else {
+			granted, _ = core.locks.Cancel(victim)
+		}
+		reply := &MessageReply{Status: "KO", Error: "Deadlock detected"}
+		if victim == intent || (victim.group != nil && victim.group == intent.group) {
+			// The query itself is cancelled
+			query.reply(reply)
+		} else {
+			reply.Id, reply.seq = id, victim.reply
+			victim.clt.Reply(reply)
+		}
+		core.grant(granted)
+	}
+}
+
+/*****************************************************************************/
+
+// notify sends the reply of a multi-lock request whose locks are all granted
+func (core *Core) notify(g *Group) {
+	g.intents[0].clt.Reply(&MessageReply{Id: g.id, Status: "OK", Value: core.tokens(g)})
+}
+
+/*****************************************************************************/
+
+// tokens arms the leases of a granted multi-lock request, and returns its
+// fencing tokens
+func (core *Core) tokens(g *Group) string {
+
+	g.done = true
+	tokens := []string{}
+	for _, it := range g.intents {
+		core.arm(it)
+		tokens = append(tokens, it.fencingToken())
+	}
+	return strings.Join(tokens, ",")
 }
 
 /*****************************************************************************/
 
-// MainServer is the main entry point of this package. It spawns TCP listener
-// and core goroutines
-func MainServer(server string) {
+// arm starts the lease of a granted lock, if any. The timer of the previous
+// lease is stopped.
+func (core *Core) arm(it *Intent) {
 
-	// Build core, and start goroutine
-	core := NewCore()
-	go core.main()
+	if it.lease == 0 {
+		return
+	}
+	it.renewal++
+	stopTimer(&it.timer)
+	it.timer = core.schedule(it.lease, &MessageQuery{oper: OP_EXPIRE, clt: it.clt, intent: it, renewal: it.renewal})
+}
+
+/*****************************************************************************/
 
-	// Build TCP listener and start goroutine
-	lis := &Listener{core: core}
-	go lis.Listen("tcp", server)
+// parseDuration converts an optional positive duration. An empty string
+// means no duration.
+func parseDuration(arg string) (time.Duration, bool) {
 
-	// Register monitoring server
-	go monitoringServer(core)
+	if arg == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil || d < 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+/*****************************************************************************/
+
+// parseLockArgs parses the mode, the timeout (argument) and the lease of a
+// locking query. An error is replied to the client if one of them is invalid.
+func parseLockArgs(query *MessageQuery) (shared bool, timeout time.Duration, lease time.Duration, ok bool) {
+
+	if shared, ok = parseMode(query.Mode); !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid lock mode"})
+	} else if timeout, ok = parseDuration(query.Arg); !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid timeout"})
+	} else if lease, ok = parseDuration(query.Lease); !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid lease"})
+	}
+	return
+}
+
+/*****************************************************************************/
+
+// parseMode converts a lock mode into a shared flag. The default mode is
+// exclusive.
+func parseMode(mode string) (shared bool, ok bool) {
+
+	switch mode {
+	case "", "exclusive":
+		return false, true
+	case "shared":
+		return true, true
+	}
+	return false, false
+}
+
+/*****************************************************************************/
+
+// tick periodically sends an internal event to the core, until it is stopped
+func (core *Core) tick(d time.Duration, oper Operation) {
+
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			core.send(&MessageQuery{oper: oper})
+		case <-core.done:
+			return
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// send sends an internal event to the core. The event is dropped if the core
+// is stopped.
+func (core *Core) send(m *MessageQuery) {
+
+	select {
+	case core.in <- m:
+	case <-core.done:
+	}
+}
+
+/*****************************************************************************/
+
+// stop stops the core goroutine, and the goroutines feeding it. It waits
+// until the current event is processed.
+func (core *Core) stop() {
+
+	close(core.done)
+	<-core.exited
+}
+
+/*****************************************************************************/
+
+// describe returns a printable identification of a client
+func describe(clt Replier) string {
+
+	if s, ok := clt.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%p", clt)
+}
+
+/*****************************************************************************/
+
+// schedule sends an internal event to the core after a given delay. The event
+// is processed by the core goroutine like any other query, so the handler has
+// to check whether it is still relevant. The timer is returned, so that it can
+// be stopped once useless, or nil if no timer is started.
+func (core *Core) schedule(d time.Duration, m *MessageQuery) *time.Timer {
+
+	// In cluster mode, only the leader runs the timers
+	if core.cluster != nil && !core.cluster.leader {
+		return nil
+	}
+	return time.AfterFunc(d, func() { core.send(m) })
+}
+
+/*****************************************************************************/
+
+// MainServer is the main entry point of this package. It starts a server,
+// and stops it gracefully on SIGINT or SIGTERM.
+func MainServer(opts *Options) error {
+
+	server := NewServer(opts)
+	if err := server.Start(); err != nil {
+		return err
+	}
 
-	// Setup SIGINT signal handler, and wait
-	channel := make(chan os.Signal)
-	signal.Notify(channel, os.Interrupt)
+	// Setup SIGINT and SIGTERM signal handler, wait, and stop gracefully
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, os.Interrupt, syscall.SIGTERM)
 	<-channel
-	log.Println("Stop")
+	server.log.Println("Stop")
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
 
 /*****************************************************************************/
@@ -0,0 +1,330 @@
+package lockserver
+
+import "testing"
+import "strconv"
+import "strings"
+import "sync/atomic"
+import "time"
+
+/*****************************************************************************/
+
+// replier is a fake client collecting the replies sent by the core
+type replier struct {
+	core *Core
+	out  chan *MessageReply
+}
+
+func newReplier(core *Core) *replier {
+	r := &replier{core: core, out: make(chan *MessageReply, 64)}
+	core.in <- &MessageQuery{clt: r, oper: OP_OPEN}
+	return r
+}
+
+func (r *replier) Reply(m *MessageReply) { r.out <- m }
+
+func (r *replier) send(op string, target string, arg string) {
+	r.core.in <- &MessageQuery{Op: op, Target: target, Arg: arg, oper: Service[op], clt: r}
+}
+
+func (r *replier) admin(op string) {
+	r.core.in <- &MessageQuery{Op: op, oper: Service[op], clt: r, admin: true}
+}
+
+func (r *replier) sendMode(op string, target string, mode string) {
+	r.core.in <- &MessageQuery{Op: op, Target: target, Mode: mode, oper: Service[op], clt: r}
+}
+
+func (r *replier) close() {
+	r.core.in <- &MessageQuery{clt: r, oper: OP_CLOSE}
+}
+
+// expect waits for the next reply, and checks its status
+func (r *replier) expect(t *testing.T, status string) *MessageReply {
+	t.Helper()
+	select {
+	case m := <-r.out:
+		if m.Status != status {
+			t.Fatalf("Expected %s, got %+v", status, m)
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected %s, got nothing", status)
+	}
+	return nil
+}
+
+// silent checks no reply is received during a given delay
+func (r *replier) silent(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case m := <-r.out:
+		t.Fatalf("Unexpected reply %+v", m)
+	case <-time.After(d):
+	}
+}
+
+func startCore() *Core {
+	core := NewCore(DefaultOptions())
+	go core.main()
+	return core
+}
+
+/*****************************************************************************/
+
+func TestLockTimeout(t *testing.T) {
+
+	core := startCore()
+	c0, c1, c2 := newReplier(core), newReplier(core), newReplier(core)
+
+	c0.send("lock", "toto", "")
+	c0.expect(t, "OK")
+	c1.send("lock", "toto", "50ms")
+	c2.send("lock", "toto", "1h")
+	c1.silent(t, 20*time.Millisecond)
+	if m := c1.expect(t, "KO"); m.Error != "Lock timeout" {
+		t.Error("Wrong error", m.Error)
+	}
+
+	// The lock is handed to the next waiter, not to the expired one
+	c0.send("unlock", "toto", "")
+	c0.expect(t, "OK")
+	c2.expect(t, "OK")
+	c1.silent(t, 20*time.Millisecond)
+
+	c1.send("lock", "toto", "soon")
+	if m := c1.expect(t, "KO"); m.Error != "Invalid timeout" {
+		t.Error("Wrong error", m.Error)
+	}
+}
+
+/*****************************************************************************/
+
+func TestTrylock(t *testing.T) {
+
+	core := startCore()
+	c0, c1 := newReplier(core), newReplier(core)
+
+	c0.send("trylock", "toto", "")
+	c0.expect(t, "OK")
+	c0.send("trylock", "toto", "")
+	c0.expect(t, "OK")
+	c1.send("trylock", "toto", "")
+	if m := c1.expect(t, "KO"); m.Value != describe(c0) {
+		t.Error("Wrong holder", m.Value)
+	}
+
+	// The failed attempt must not be queued
+	c0.send("unlock", "toto", "")
+	c0.expect(t, "OK")
+	c1.silent(t, 20*time.Millisecond)
+	c1.send("trylock", "toto", "")
+	c1.expect(t, "OK")
+}
+
+/*****************************************************************************/
+
+func TestSharedLock(t *testing.T) {
+
+	core := startCore()
+	c0, c1, c2 := newReplier(core), newReplier(core), newReplier(core)
+
+	c0.sendMode("lock", "toto", "shared")
+	c0.expect(t, "OK")
+	c1.sendMode("lock", "toto", "shared")
+	c1.expect(t, "OK")
+	c2.sendMode("trylock", "toto", "exclusive")
+	c2.expect(t, "KO")
+	c2.send("lock", "toto", "")
+	c2.silent(t, 20*time.Millisecond)
+
+	c0.sendMode("unlock", "toto", "exclusive")
+	if m := c0.expect(t, "KO"); m.Error != "Lock mode mismatch" {
+		t.Error("Wrong error", m.Error)
+	}
+	c0.sendMode("unlock", "toto", "shared")
+	c0.expect(t, "OK")
+	c2.silent(t, 20*time.Millisecond)
+	c1.close()
+	c2.expect(t, "OK")
+
+	c0.sendMode("lock", "toto", "whatever")
+	if m := c0.expect(t, "KO"); m.Error != "Invalid lock mode" {
+		t.Error("Wrong error", m.Error)
+	}
+	// A held lock cannot be requested again in another mode
+	c2.sendMode("lock", "toto", "shared")
+	if m := c2.expect(t, "KO"); m.Error != "Already locked in another mode" {
+		t.Error("Wrong error", m.Error)
+	}
+	c2.sendMode("trylock", "toto", "shared")
+	if m := c2.expect(t, "KO"); m.Error != "Already locked in another mode" {
+		t.Error("Wrong error", m.Error)
+	}
+	c2.send("lock", "toto", "")
+	c2.expect(t, "OK")
+}
+
+/*****************************************************************************/
+
+func TestLease(t *testing.T) {
+
+	core := startCore()
+	c0, c1 := newReplier(core), newReplier(core)
+
+	core.in <- &MessageQuery{Op: "lock", Target: "toto", Lease: "100ms", oper: OP_LOCK, clt: c0}
+	c0.expect(t, "OK")
+	c1.send("lock", "toto", "")
+	c1.silent(t, 50*time.Millisecond)
+	c0.send("renew", "toto", "200ms")
+	c0.expect(t, "OK")
+	c1.silent(t, 100*time.Millisecond)
+
+	// Once expired, the lock is handed to the next waiter
+	c1.expect(t, "OK")
+	c0.send("renew", "toto", "")
+	if m := c0.expect(t, "KO"); m.Error != "Cannot find this lock" {
+		t.Error("Wrong error", m.Error)
+	}
+	c1.send("renew", "toto", "")
+	if m := c1.expect(t, "KO"); m.Error != "No lease on this lock" {
+		t.Error("Wrong error", m.Error)
+	}
+}
+
+/*****************************************************************************/
+
+func TestFencingToken(t *testing.T) {
+
+	core := startCore()
+	c0, c1, c2 := newReplier(core), newReplier(core), newReplier(core)
+
+	c0.send("lock", "toto", "")
+	t0 := c0.expect(t, "OK").Value
+	c1.send("lock", "toto", "")
+	c0.send("unlock", "toto", "")
+	c0.expect(t, "OK")
+	t1 := c1.expect(t, "OK").Value
+
+	n0, _ := strconv.ParseUint(t0, 10, 64)
+	n1, _ := strconv.ParseUint(t1, 10, 64)
+	if n0 == 0 || n1 <= n0 {
+		t.Error("Tokens not increasing", t0, t1)
+	}
+
+	// Only the token of the current holder is valid
+	c2.send("check", "toto", t1)
+	c2.expect(t, "OK")
+	c2.send("check", "toto", t0)
+	if m := c2.expect(t, "KO"); m.Error != "Stale token" {
+		t.Error("Wrong error", m.Error)
+	}
+	c2.send("check", "toto", "x")
+	if m := c2.expect(t, "KO"); m.Error != "Invalid token" {
+		t.Error("Wrong error", m.Error)
+	}
+}
+
+/*****************************************************************************/
+
+func TestRequestId(t *testing.T) {
+
+	core := startCore()
+	c0, c1 := newReplier(core), newReplier(core)
+
+	c0.send("lock", "toto", "")
+	c0.expect(t, "OK")
+	c0.send("lock", "titi", "")
+	c0.expect(t, "OK")
+	core.in <- &MessageQuery{Id: "l1", Op: "lock", Target: "toto", oper: OP_LOCK, clt: c1}
+	core.in <- &MessageQuery{Id: "l2", Op: "lock", Target: "titi", Arg: "20ms", oper: OP_LOCK, clt: c1}
+	core.in <- &MessageQuery{Id: "g1", Op: "get", Target: "counter", oper: OP_GET, clt: c1}
+	core.in <- &MessageQuery{Id: "x1", Op: "oops", clt: c1}
+
+	if m := c1.expect(t, "OK"); m.Id != "g1" {
+		t.Error("Wrong id", m.Id)
+	}
+	if m := c1.expect(t, "KO"); m.Id != "x1" {
+		t.Error("Wrong id", m.Id)
+	}
+	if m := c1.expect(t, "KO"); m.Id != "l2" || m.Error != "Lock timeout" {
+		t.Error("Wrong timeout reply", m)
+	}
+
+	// The deferred grant carries the id of the lock request
+	c0.send("unlock", "toto", "")
+	c0.expect(t, "OK")
+	if m := c1.expect(t, "OK"); m.Id != "l1" {
+		t.Error("Wrong id", m.Id)
+	}
+}
+
+/*****************************************************************************/
+
+func TestLockall(t *testing.T) {
+
+	core := startCore()
+	c0, c1, c2 := newReplier(core), newReplier(core), newReplier(core)
+
+	c2.send("lock", "tutu", "")
+	c2.expect(t, "OK")
+
+	// Overlapping sets requested in a different order do not deadlock
+	core.in <- &MessageQuery{Id: "a", Op: "lockall", Targets: []string{"toto", "tutu"}, oper: OP_LOCKALL, clt: c0}
+	core.in <- &MessageQuery{Id: "b", Op: "lockall", Targets: []string{"tutu", "toto", "tutu"}, oper: OP_LOCKALL, clt: c1}
+	c0.silent(t, 20*time.Millisecond)
+	c2.send("unlock", "tutu", "")
+	c2.expect(t, "OK")
+	m := c0.expect(t, "OK")
+	if m.Id != "a" || len(strings.Split(m.Value, ",")) != 2 {
+		t.Error("Wrong reply", m)
+	}
+	c1.silent(t, 20*time.Millisecond)
+	c0.close()
+	if m = c1.expect(t, "OK"); m.Id != "b" || len(strings.Split(m.Value, ",")) != 2 {
+		t.Error("Wrong reply", m)
+	}
+
+	// On timeout, none of the locks is kept
+	core.in <- &MessageQuery{Op: "lockall", Targets: []string{"titi", "toto"}, Arg: "20ms", oper: OP_LOCKALL, clt: c2}
+	if m = c2.expect(t, "KO"); m.Error != "Lock timeout" {
+		t.Error("Wrong error", m.Error)
+	}
+	c0 = newReplier(core)
+	c0.send("trylock", "titi", "")
+	c0.expect(t, "OK")
+	c1.send("lock", "toto", "")
+	c1.expect(t, "OK")
+	core.in <- &MessageQuery{Op: "lockall", Targets: []string{"titi", "toto"}, oper: OP_LOCKALL, clt: c1}
+	if m = c1.expect(t, "KO"); m.Error != "Lock already requested" {
+		t.Error("Wrong error", m.Error)
+	}
+}
+
+/*****************************************************************************/
+
+func TestDeadlock(t *testing.T) {
+
+	core := startCore()
+	c0, c1 := newReplier(core), newReplier(core)
+
+	c0.send("lock", "toto", "")
+	c0.expect(t, "OK")
+	c1.send("lock", "tutu", "")
+	c1.expect(t, "OK")
+	c0.send("lock", "tutu", "1h")
+	c0.silent(t, 20*time.Millisecond)
+
+	// The youngest request of the cycle is rejected
+	core.in <- &MessageQuery{Id: "d", Op: "lock", Target: "toto", oper: OP_LOCK, clt: c1}
+	if m := c1.expect(t, "KO"); m.Error != "Deadlock detected" || m.Id != "d" {
+		t.Error("Wrong reply", m)
+	}
+	c1.send("unlock", "tutu", "")
+	c1.expect(t, "OK")
+	c0.expect(t, "OK")
+	if atomic.LoadInt64(&core.deadlocks) != 1 {
+		t.Error("Wrong deadlock counter")
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,238 @@
+// This file contains the metrics of the server, exposed in the Prometheus
+// text format on the /metrics path of the monitoring server. The cores update
+// them with atomic operations, and the HTTP handler reads them concurrently,
+// so that a scrape never waits for the cores.
+
+package lockserver
+
+import "fmt"
+import "io"
+import "net/http"
+import "sort"
+import "sync/atomic"
+import "time"
+
+/*****************************************************************************/
+
+// opLimit is an upper bound of the operation codes
+const opLimit = 64
+
+// latencyBuckets are the upper bounds of the buckets of the processing time
+// of the core events, in seconds
+var latencyBuckets = []float64{1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4, 2.5e-4, 5e-4, 1e-3, 1e-2, 0.1}
+
+// waitBuckets are the upper bounds of the buckets of the lock wait time, in
+// seconds
+var waitBuckets = []float64{1e-4, 1e-3, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+/*****************************************************************************/
+
+// histogram counts some durations in fixed buckets. It is updated and read
+// concurrently with atomic operations.
+type histogram struct {
+	bounds []float64 // Upper bounds of the buckets, in seconds
+	counts []int64   // Number of observations by bucket, the last one unbounded
+	sum    int64     // Sum of the observations, in nanoseconds
+}
+
+/*****************************************************************************/
+
+// newHistogram builds an empty histogram
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+/*****************************************************************************/
+
+// observe counts a duration in its bucket
+func (h *histogram) observe(d time.Duration) {
+
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+/*****************************************************************************/
+
+// coreMetrics gathers the metrics of a core
+type coreMetrics struct {
+	ops     [opLimit]int64 // Number of processed queries, by operation
+	latency *histogram     // Processing time of the events
+	waits   *histogram     // Wait time of the granted lock intents
+	held    int64          // Number of granted lock intents
+	waiters int64          // Number of queued lock intents
+}
+
+/*****************************************************************************/
+
+// newCoreMetrics builds the metrics of a core
+func newCoreMetrics() *coreMetrics {
+	return &coreMetrics{latency: newHistogram(latencyBuckets), waits: newHistogram(waitBuckets)}
+}
+
+/*****************************************************************************/
+
+// record updates the metrics once an event has been processed
+func (core *Core) record(m *MessageQuery, start time.Time) {
+
+	mt := core.metrics
+	mt.latency.observe(time.Since(start))
+	if m.oper < opLimit && !m.committed {
+		atomic.AddInt64(&mt.ops[m.oper], 1)
+	}
+	held, waiters := core.locks.Counts()
+	atomic.StoreInt64(&mt.held, int64(held))
+	atomic.StoreInt64(&mt.waiters, int64(waiters))
+}
+
+/*****************************************************************************/
+
+// sample is a copy of the counters of the server
+type sample struct {
+	count  int64            // Number of processed events
+	ops    map[string]int64 // Number of processed queries, by operation
+	errors int64            // Number of error replies
+}
+
+/*****************************************************************************/
+
+// sample copies the counters of all the shards
+func (rt *Router) sample() *sample {
+
+	smp := &sample{count: rt.count(), ops: make(map[string]int64, len(Service)), errors: atomic.LoadInt64(&rt.errors)}
+	for name, oper := range Service {
+		for _, core := range rt.shards {
+			smp.ops[name] += atomic.LoadInt64(&core.metrics.ops[oper])
+		}
+	}
+	return smp
+}
+
+/*****************************************************************************/
+
+// lockCounts returns the number of granted and queued lock intents of all
+// the shards
+func (rt *Router) lockCounts() (int64, int64) {
+
+	var held, waiters int64
+	for _, core := range rt.shards {
+		held += atomic.LoadInt64(&core.metrics.held)
+		waiters += atomic.LoadInt64(&core.metrics.waiters)
+	}
+	return held, waiters
+}
+
+/*****************************************************************************/
+
+// queueDepth returns the number of events waiting in the incoming channels of
+// the shards
+func (rt *Router) queueDepth() int {
+
+	n := 0
+	for _, core := range rt.shards {
+		n += len(core.in)
+	}
+	return n
+}
+
+/*****************************************************************************/
+
+// clients returns the number of open network connections
+func (rt *Router) clients() int {
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	return len(rt.conns)
+}
+
+/*****************************************************************************/
+
+// writeMetrics writes the metrics of all the shards in the Prometheus text
+// format
+func (rt *Router) writeMetrics(w io.Writer) {
+
+	// Queries by operation
+	smp := rt.sample()
+	names := make([]string, 0, len(smp.ops))
+	for name := range smp.ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeHeader(w, "lockserver_queries_total", "counter", "Queries processed by the cores, by operation.")
+	for _, name := range names {
+		fmt.Fprintf(w, "lockserver_queries_total{op=%q} %d\n", name, smp.ops[name])
+	}
+
+	// Other counters and gauges
+	held, waiters := rt.lockCounts()
+	writeMetric(w, "lockserver_errors_total", "counter", "Error replies sent to the connections.", smp.errors)
+	writeMetric(w, "lockserver_deadlocks_total", "counter", "Deadlocks detected by the cores.", rt.deadlocks())
+	writeMetric(w, "lockserver_denials_total", "counter", "Queries denied to the clients.", rt.denials())
+	writeMetric(w, "lockserver_slow_clients_total", "counter", "Clients disconnected as too slow.", rt.slowClients())
+	writeMetric(w, "lockserver_clients", "gauge", "Open network connections.", int64(rt.clients()))
+	writeMetric(w, "lockserver_locks_held", "gauge", "Granted lock intents.", held)
+	writeMetric(w, "lockserver_lock_waiters", "gauge", "Queued lock intents.", waiters)
+	writeHeader(w, "lockserver_queue_depth", "gauge", "Events waiting in the incoming channel of the cores, by shard.")
+	for i, core := range rt.shards {
+		fmt.Fprintf(w, "lockserver_queue_depth{shard=\"%d\"} %d\n", i, len(core.in))
+	}
+
+	// Histograms
+	var latency, waits []*histogram
+	for _, core := range rt.shards {
+		latency = append(latency, core.metrics.latency)
+		waits = append(waits, core.metrics.waits)
+	}
+	writeHistogram(w, "lockserver_core_latency_seconds", "Processing time of the events by the core loop.", latency)
+	writeHistogram(w, "lockserver_lock_wait_seconds", "Wait time of the granted lock intents.", waits)
+}
+
+/*****************************************************************************/
+
+// writeHeader writes the help and type lines of a metric
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+/*****************************************************************************/
+
+// writeMetric writes a metric with a single value
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+
+	writeHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+/*****************************************************************************/
+
+// writeHistogram writes the sum of some histograms sharing the same buckets
+func writeHistogram(w io.Writer, name string, help string, hs []*histogram) {
+
+	writeHeader(w, name, "histogram", help)
+	var count, sum int64
+	for i := range hs[0].counts {
+		for _, h := range hs {
+			count += atomic.LoadInt64(&h.counts[i])
+		}
+		le := "+Inf"
+		if i < len(hs[0].bounds) {
+			le = fmt.Sprint(hs[0].bounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, count)
+	}
+	for _, h := range hs {
+		sum += atomic.LoadInt64(&h.sum)
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, time.Duration(sum).Seconds(), name, count)
+}
+
+/*****************************************************************************/
+
+// serveMetrics is the HTTP handler of the metrics
+func (mon *Monitor) serveMetrics(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mon.router.writeMetrics(w)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,111 @@
+package lockserver
+
+import "bufio"
+import "encoding/json"
+import "io"
+import "net"
+import "net/http"
+import "strings"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func TestHistogram(t *testing.T) {
+
+	h := newHistogram([]float64{0.001, 0.01})
+	h.observe(500 * time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Second)
+	var b strings.Builder
+	writeHistogram(&b, "x", "Test.", []*histogram{h, h})
+	want := `# HELP x Test.
+# TYPE x histogram
+x_bucket{le="0.001"} 4
+x_bucket{le="0.01"} 6
+x_bucket{le="+Inf"} 8
+x_sum 2.013
+x_count 8
+`
+	if b.String() != want {
+		t.Errorf("Wrong histogram:\n%s", b.String())
+	}
+}
+
+/*****************************************************************************/
+
+func TestMetrics(t *testing.T) {
+
+	server := testServer(t, nil)
+	connect := func() (*json.Encoder, *json.Decoder) {
+		t.Helper()
+		con, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { con.Close() })
+		con.SetDeadline(time.Now().Add(5 * time.Second))
+		return json.NewEncoder(con), json.NewDecoder(bufio.NewReader(con))
+	}
+	enc0, dec0 := connect()
+	enc1, dec1 := connect()
+
+	// One lock held, one waiter, and an error
+	m := &MessageReply{}
+	for _, q := range []*MessageQuery{
+		{Op: "lock", Target: "toto"},
+		{Op: "incr", Target: "titi", Arg: "1"},
+		{Op: "unlock", Target: "tutu"},
+	} {
+		enc0.Encode(q)
+		dec0.Decode(m)
+	}
+	enc1.Encode(&MessageQuery{Op: "lock", Target: "toto"})
+	time.Sleep(50 * time.Millisecond)
+
+	metrics := func() string {
+		t.Helper()
+		resp, err := http.Get("http://" + server.MonitorAddr().String() + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Error("Wrong content type", ct)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	check := func(text string, lines ...string) {
+		t.Helper()
+		for _, line := range lines {
+			if !strings.Contains(text, "\n"+line+"\n") {
+				t.Errorf("Missing %q in:\n%s", line, text)
+			}
+		}
+	}
+	check(metrics(),
+		`lockserver_queries_total{op="lock"} 2`,
+		`lockserver_queries_total{op="incr"} 1`,
+		`lockserver_queries_total{op="get"} 0`,
+		`lockserver_errors_total 1`,
+		`lockserver_clients 2`,
+		`lockserver_locks_held 1`,
+		`lockserver_lock_waiters 1`,
+		`lockserver_queue_depth{shard="0"} 0`,
+		`lockserver_lock_wait_seconds_count 1`)
+
+	// The waiter gets the lock
+	enc0.Encode(&MessageQuery{Op: "unlock", Target: "toto"})
+	dec0.Decode(m)
+	if err := dec1.Decode(m); err != nil || m.Status != "OK" {
+		t.Fatal("Wrong reply", m, err)
+	}
+	check(metrics(),
+		`lockserver_locks_held 1`,
+		`lockserver_lock_waiters 0`,
+		`lockserver_lock_wait_seconds_count 2`)
+}
+
+/*****************************************************************************/
@@ -1,39 +1,155 @@
+// This file contains the monitoring HTTP server. It serves the dashboard page
+// on /, the live counters on the /monitoring websocket, the metrics on
+// /metrics, and the HTTP gateway.
+
 package lockserver
 
-import "log"
+import "context"
+import "crypto/tls"
+import _ "embed"
+import "io"
+import "net"
 import "net/http"
 import "code.google.com/p/go.net/websocket"
+import "sync"
 import "time"
-import "sync/atomic"
 
 /*****************************************************************************/
 
+// topContended is the number of contended locks sent to the websockets
+const topContended = 10
+
+// dashboard is the page displaying the live counters of the websocket
+//
+//go:embed dashboard.html
+var dashboard string
+
+/*****************************************************************************/
+
+// ResultJson is the payload sent to the monitoring websockets every half
+// second. The rates are given per second.
 type ResultJson struct {
-	Tps int64
+	Tps         int64
+	Deadlocks   int64
+	Denials     int64
+	SlowClients int64
+	Rates       map[string]int64 // Queries by operation
+	Errors      int64            // Error replies
+	Clients     int              // Open network connections
+	LocksHeld   int64            // Granted lock intents
+	LockWaiters int64            // Queued lock intents
+	QueueDepth  int              // Events waiting in the incoming channels of the cores
+	Contended   []Contention     // Locks with the most queued intents
+}
+
+/*****************************************************************************/
+
+// Monitor is the HTTP server of the monitoring websocket and of the gateway
+type Monitor struct {
+	router  *Router      // Core shards
+	gateway *Gateway     // HTTP gateway
+	server  *http.Server // HTTP server, with TLS if configured
+	lis     net.Listener // TCP listener
+	done    chan bool    // Closed to disconnect the websockets
+	once    sync.Once    // Protects done
+}
+
+/*****************************************************************************/
+
+// NewMonitor builds a Monitor object. The config is nil for plain HTTP. When
+// the authentication is enabled, the monitoring pages need the credentials of
+// a user, like the gateway.
+func NewMonitor(router *Router, ttl time.Duration, config *tls.Config) *Monitor {
+
+	mon := &Monitor{router: router, gateway: NewGateway(router, ttl), done: make(chan bool)}
+	mux := http.NewServeMux()
+	mux.Handle("/monitoring", mon.authenticated(websocket.Handler(mon.serveWebsocket)))
+	mux.Handle("/metrics", mon.authenticated(http.HandlerFunc(mon.serveMetrics)))
+	mux.Handle("/", mon.authenticated(http.HandlerFunc(mon.serveDashboard)))
+	mon.gateway.register(mux)
+	mon.server = &http.Server{Handler: mux, TLSConfig: config}
+	return mon
+}
+
+/*****************************************************************************/
+
+// Listen opens the HTTP server, and starts serving the requests
+func (mon *Monitor) Listen(addr string) error {
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mon.router.log.Printf("Monitoring on %s\n", lis.Addr())
+	mon.lis = lis
+	if mon.server.TLSConfig != nil {
+		go mon.server.ServeTLS(lis, "", "")
+	} else {
+		go mon.server.Serve(lis)
+	}
+	return nil
 }
 
-var Counter *int64
+/*****************************************************************************/
+
+// Shutdown stops the HTTP server gracefully, and closes the sessions of the
+// gateway
+func (mon *Monitor) Shutdown(ctx context.Context) error {
+
+	mon.once.Do(func() { close(mon.done) })
+	err := mon.server.Shutdown(ctx)
+	mon.gateway.closeAll()
+	return err
+}
 
 /*****************************************************************************/
 
-func MonitoringServer(ws *websocket.Conn) {
+// Close stops the HTTP server immediately
+func (mon *Monitor) Close() {
 
-	log.Println("Connected")
+	mon.once.Do(func() { close(mon.done) })
+	mon.server.Close()
+}
+
+/*****************************************************************************/
+
+// authenticated wraps a handler, so that it is only called for the requests
+// with valid credentials
+func (mon *Monitor) authenticated(h http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := mon.gateway.authenticate(w, req); ok {
+			h.ServeHTTP(w, req)
+		}
+	})
+}
+
+/*****************************************************************************/
+
+// serveWebsocket sends the counters of the server to a websocket client every
+// half second, until it disconnects or the server stops
+func (mon *Monitor) serveWebsocket(ws *websocket.Conn) {
+
+	logger := mon.router.log
+	logger.Println("Connected")
 
 	done := make(chan bool)
 	go func() {
-		cnt := atomic.LoadInt64(Counter)
+		prev := mon.router.sample()
 		for {
 			select {
 			case <-done:
 				return
+			case <-mon.done:
+				ws.Close()
+				return
 			case <-time.After(time.Second / 2):
-				cur := atomic.LoadInt64(Counter)
-				delta := 2 * (cur - cnt)
-				cnt = cur
-				err := websocket.JSON.Send(ws, ResultJson{Tps: delta})
+				cur := mon.router.sample()
+				res := mon.result(prev, cur)
+				prev = cur
+				err := websocket.JSON.Send(ws, res)
 				if err != nil {
-					log.Println("Error send", err)
+					logger.Println("Error send", err)
 					return
 				}
 			}
@@ -44,19 +160,85 @@ func MonitoringServer(ws *websocket.Conn) {
 	for {
 		err := websocket.Message.Receive(ws, &msg)
 		if err != nil {
-			done <- true
+			close(done)
 			break
 		}
 	}
-	log.Println("Disconnected")
+	logger.Println("Disconnected")
 }
 
 /*****************************************************************************/
 
-func monitoringServer(core *Core) {
-	Counter = &core.count
-	http.Handle("/monitoring", websocket.Handler(MonitoringServer))
-	http.ListenAndServe(":4010", nil)
+// result builds the payload of the websockets from two samples of the
+// counters, taken half a second apart
+func (mon *Monitor) result(prev *sample, cur *sample) *ResultJson {
+
+	rt := mon.router
+	res := &ResultJson{
+		Tps:         2 * (cur.count - prev.count),
+		Deadlocks:   rt.deadlocks(),
+		Denials:     rt.denials(),
+		SlowClients: rt.slowClients(),
+		Rates:       make(map[string]int64, len(cur.ops)),
+		Errors:      2 * (cur.errors - prev.errors),
+		Clients:     rt.clients(),
+		QueueDepth:  rt.queueDepth(),
+		Contended:   mon.contention(),
+	}
+	for name, n := range cur.ops {
+		res.Rates[name] = 2 * (n - prev.ops[name])
+	}
+	res.LocksHeld, res.LockWaiters = rt.lockCounts()
+	return res
+}
+
+/*****************************************************************************/
+
+// contention returns the most contended locks of all the shards. The cores
+// are queried like for any other event; nil is returned if the server stops
+// meanwhile.
+func (mon *Monitor) contention() []Contention {
+
+	shards := mon.router.shards
+	w := make(waiter, len(shards))
+	for _, core := range shards {
+		core.send(&MessageQuery{oper: OP_CONTENTION, clt: w})
+	}
+	res := []Contention{}
+	for range shards {
+		select {
+		case r := <-w:
+			res = append(res, r.locks...)
+		case <-mon.done:
+			return nil
+		}
+	}
+	sortContention(res)
+	if len(res) > topContended {
+		res = res[:topContended]
+	}
+	return res
+}
+
+/*****************************************************************************/
+
+// handleContention replies with the most contended locks of the core, for the
+// monitoring server
+func (core *Core) handleContention(query *MessageQuery) {
+	query.clt.Reply(&MessageReply{Status: "OK", locks: core.locks.Contended(topContended)})
+}
+
+/*****************************************************************************/
+
+// serveDashboard serves the dashboard page
+func (mon *Monitor) serveDashboard(w http.ResponseWriter, req *http.Request) {
+
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, dashboard)
 }
 
 /*****************************************************************************/
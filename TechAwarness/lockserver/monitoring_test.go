@@ -0,0 +1,128 @@
+package lockserver
+
+import "bufio"
+import "encoding/base64"
+import "encoding/json"
+import "io"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "code.google.com/p/go.net/websocket"
+import "time"
+
+/*****************************************************************************/
+
+func TestMonitoring(t *testing.T) {
+
+	server := testServer(t, nil)
+	query := func(q *MessageQuery) {
+		t.Helper()
+		con, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { con.Close() })
+		json.NewEncoder(con).Encode(q)
+		if q.Id == "" {
+			con.SetDeadline(time.Now().Add(5 * time.Second))
+			m := &MessageReply{}
+			if err := json.NewDecoder(bufio.NewReader(con)).Decode(m); err != nil || m.Status != "OK" {
+				t.Fatal("Wrong reply", m, err)
+			}
+		}
+	}
+
+	// toto has two waiters, titi has one
+	query(&MessageQuery{Op: "lockall", Targets: []string{"toto", "titi"}})
+	query(&MessageQuery{Id: "w1", Op: "lock", Target: "toto"})
+	query(&MessageQuery{Id: "w2", Op: "lock", Target: "toto"})
+	query(&MessageQuery{Id: "w3", Op: "lock", Target: "titi"})
+
+	// The dashboard is served on /
+	base := "http://" + server.MonitorAddr().String()
+	resp, err := http.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "/monitoring") {
+		t.Error("Wrong dashboard", resp.StatusCode)
+	}
+	resp, err = http.Get(base + "/oops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Wrong status", resp.StatusCode)
+	}
+
+	// The websocket sends the counters
+	ws, err := websocket.Dial("ws://"+server.MonitorAddr().String()+"/monitoring", "", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	var res ResultJson
+	if err := websocket.JSON.Receive(ws, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Clients != 4 || res.LocksHeld != 2 || res.LockWaiters != 3 {
+		t.Errorf("Wrong counters %+v", res)
+	}
+	if len(res.Contended) != 2 || res.Contended[0] != (Contention{"toto", 2}) || res.Contended[1] != (Contention{"titi", 1}) {
+		t.Error("Wrong contention", res.Contended)
+	}
+	if _, ok := res.Rates["lock"]; !ok {
+		t.Error("Missing rates", res.Rates)
+	}
+}
+
+/*****************************************************************************/
+
+func TestMonitoringAuth(t *testing.T) {
+
+	router := startShards(1)
+	router.auth = testAuth(t)
+	mon := NewMonitor(router, time.Hour, nil)
+	defer mon.Close()
+	server := httptest.NewServer(mon.server.Handler)
+	defer server.Close()
+
+	// The monitoring pages need valid credentials
+	for _, path := range []string{"/", "/metrics", "/monitoring"} {
+		for _, password := range []string{"", "oops", "pass"} {
+			req, _ := http.NewRequest("GET", server.URL+path, nil)
+			if password != "" {
+				req.SetBasicAuth("stats", password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if (resp.StatusCode == http.StatusUnauthorized) != (password != "pass") {
+				t.Errorf("GET %s with %q: wrong status %d", path, password, resp.StatusCode)
+			}
+		}
+	}
+
+	// The websocket as well
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/monitoring"
+	if _, err := websocket.Dial(url, "", server.URL); err == nil {
+		t.Error("Websocket without credentials")
+	}
+	config, _ := websocket.NewConfig(url, server.URL)
+	config.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("stats:pass")))
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+}
+
+/*****************************************************************************/
@@ -0,0 +1,68 @@
+package lockserver
+
+import "log"
+import "time"
+
+/*****************************************************************************/
+
+// Options gathers the configuration of the server
+type Options struct {
+	Addr             string        // Listening address (host:port)
+	MonitorAddr      string        // Listening address of the monitoring and HTTP gateway, empty to disable
+	Shards           int           // Number of core shards
+	RespAddr         string        // Listening address of the Redis protocol, empty to disable
+	AdminAddr        string        // Listening address of the administration operations, empty to disable
+	AuthFile         string        // Credentials file, empty to disable authentication
+	TLSCert          string        // Certificate file of the server, empty to disable TLS
+	TLSKey           string        // Private key file of the server
+	TLSClientCA      string        // CA file of the client certificates, empty to disable mutual TLS
+	SessionTTL       time.Duration // Default idle time before the HTTP sessions expire
+	DataDir          string        // Persistence directory, empty to disable persistence, or Raft state in cluster mode
+	Sync             SyncPolicy    // Fsync policy of the log
+	SyncInterval     time.Duration // Fsync period, for the periodic policy
+	SnapshotInterval time.Duration // Period of the snapshots
+	ReplicationAddr  string        // Listening address of the followers, empty to disable
+	Follow           string        // Replication address of the primary, empty for a primary
+	ClusterPeers     []string      // Raft addresses of the cluster nodes, empty to disable cluster mode
+	ClusterID        int           // Index of this node in ClusterPeers
+	RaftTick         time.Duration // Tick period of the Raft protocol
+	ShutdownTimeout  time.Duration // Maximum time given to the connections to write their replies at shutdown
+	ChannelSize      int           // Size of the incoming channels of the cores, in units of 128 queries
+	ReplyQueue       int           // Maximum number of replies queued for a connection, before it is disconnected
+	WriteTimeout     time.Duration // Maximum time to write a reply to a connection, 0 to disable
+	Verbose          bool          // Log every query
+	Logger           *log.Logger   // Logger of the server, nil for the standard logger
+}
+
+/*****************************************************************************/
+
+// DefaultOptions builds an Options object with the default values
+func DefaultOptions() *Options {
+	return &Options{
+		Addr:             ":4002",
+		MonitorAddr:      ":4010",
+		Shards:           1,
+		SessionTTL:       30 * time.Second,
+		Sync:             SYNC_PERIODIC,
+		SyncInterval:     time.Second,
+		SnapshotInterval: time.Minute,
+		RaftTick:         20 * time.Millisecond,
+		ShutdownTimeout:  10 * time.Second,
+		ChannelSize:      16,
+		ReplyQueue:       1024,
+		WriteTimeout:     10 * time.Second,
+	}
+}
+
+/*****************************************************************************/
+
+// logger returns the logger of the server
+func (opts *Options) logger() *log.Logger {
+
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	return log.Default()
+}
+
+/*****************************************************************************/
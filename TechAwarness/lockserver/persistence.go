@@ -0,0 +1,307 @@
+// This file contains the persistence code of the key/value data structure.
+
+package lockserver
+
+import "bufio"
+import "encoding/json"
+import "errors"
+import "io"
+import "os"
+import "path/filepath"
+
+/*****************************************************************************/
+
+// SyncPolicy is an enumerate listing the fsync policies of the log
+type SyncPolicy int
+
+const (
+	SYNC_ALWAYS   = iota // Fsync after each record
+	SYNC_PERIODIC        // Fsync periodically, driven by the core
+	SYNC_NEVER           // Let the operating system flush the data
+)
+
+// SyncPolicies is a map to convert a policy name into an enumerate
+var SyncPolicies = map[string]SyncPolicy{
+	"always":   SYNC_ALWAYS,
+	"periodic": SYNC_PERIODIC,
+	"never":    SYNC_NEVER,
+}
+
+/*****************************************************************************/
+
+// Record is a mutation of the key/value data structure, as stored in the log.
+// The log is a text file containing one JSON record per line, e.g.:
+//
+//	{"Seq":41,"Op":"set","Target":"counter","Value":0}
+//	{"Seq":42,"Op":"incr","Target":"counter","Value":1}
+//
+// Value is the new value for a set, and the increment for an incr. Two other
+// records are used by followers and fencing tokens: reset (removes all the
+// key/value pairs) and epoch (Value is the new fencing epoch, without
+// target). Sequence numbers are strictly increasing.
+type Record struct {
+	Seq    uint64
+	Op     string
+	Target string
+	Value  int64
+}
+
+// Snapshot is the content of the snapshot file: a single JSON object with the
+// sequence number of the last record included in the snapshot, the fencing
+// epoch, and all the key/value pairs, e.g.:
+//
+//	{"Seq":42,"Epoch":3,"Stats":{"counter":1}}
+type Snapshot struct {
+	Seq   uint64
+	Epoch uint64
+	Stats map[string]int64
+}
+
+/*****************************************************************************/
+
+// Store is the persistence layer of the key/value data structure. It is made
+// of a snapshot file (stats.snap) and a write-ahead log (stats.log) of the
+// mutations applied after the snapshot. It is only used by the core goroutine.
+type Store struct {
+	dir     string     // Persistence directory
+	policy  SyncPolicy // Fsync policy of the log
+	log     *os.File   // Write-ahead log file
+	size    int64      // Size of the complete records of the log
+	seq     uint64     // Sequence number of the last record
+	snapSeq uint64     // Sequence number of the last snapshot
+	epoch   uint64     // Last fencing epoch
+	dirty   bool       // True if some records have not been fsynced
+	failed  error      // Set if the log cannot be restored after a failed write
+}
+
+/*****************************************************************************/
+
+// OpenStore opens the persistence files of a directory, creating them if
+// needed. The snapshot is loaded, and the log replayed, to return the current
+// key/value pairs. An incomplete or corrupted record at the end of the log
+// (interrupted write) is discarded.
+func OpenStore(dir string, policy SyncPolicy) (*Store, map[string]int64, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	st := &Store{dir: dir, policy: policy}
+
+	// Load the snapshot
+	snap := &Snapshot{Stats: make(map[string]int64)}
+	if data, err := os.ReadFile(st.path("stats.snap")); err == nil {
+		if err := json.Unmarshal(data, snap); err != nil {
+			return nil, nil, err
+		}
+		if snap.Stats == nil {
+			snap.Stats = make(map[string]int64)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	st.seq, st.snapSeq, st.epoch = snap.Seq, snap.Seq, snap.Epoch
+
+	// Replay the log
+	f, err := os.OpenFile(st.path("stats.log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	valid, err := st.replay(f, snap.Stats)
+	if err == nil {
+		// Discard an incomplete record, and append the next ones
+		if err = f.Truncate(valid); err == nil {
+			_, err = f.Seek(valid, io.SeekStart)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	st.log, st.size = f, valid
+	return st, snap.Stats, nil
+}
+
+/*****************************************************************************/
+
+// replay applies the records of the log which are more recent than the
+// snapshot. It returns the size of the valid part of the log.
+func (st *Store) replay(f *os.File, stats map[string]int64) (int64, error) {
+
+	reader := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Only complete lines are considered
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+		r := &Record{}
+		if err := json.Unmarshal(line, r); err != nil {
+			// Only the last record can be torn by a crash
+			if _, err := reader.Peek(1); err == io.EOF {
+				return valid, nil
+			}
+			return 0, errors.New("Corrupted log record: " + string(line))
+		}
+		valid += int64(len(line))
+
+		// Records already included in the snapshot are ignored
+		if r.Seq <= st.seq {
+			continue
+		}
+		st.seq = r.Seq
+		switch r.Op {
+		case "set":
+			stats[r.Target] = r.Value
+		case "incr":
+			stats[r.Target] += r.Value
+		case "reset":
+			for k := range stats {
+				delete(stats, k)
+			}
+		case "epoch":
+			st.epoch = uint64(r.Value)
+		default:
+			return 0, errors.New("Unknown log record: " + string(line))
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// Append writes a record to the log. It must be called before the mutation is
+// applied. On error, the record is removed from the log, and the mutation must
+// not be applied.
+func (st *Store) Append(op string, target string, value int64) error {
+
+	if st.failed != nil {
+		return st.failed
+	}
+	data, err := json.Marshal(&Record{Seq: st.seq + 1, Op: op, Target: target, Value: value})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := st.log.Write(data); err != nil {
+		st.rollback(err)
+		return err
+	}
+	st.dirty = true
+	if st.policy == SYNC_ALWAYS {
+		if err := st.Sync(); err != nil {
+			st.rollback(err)
+			return err
+		}
+	}
+	st.seq++
+	st.size += int64(len(data))
+	if op == "epoch" {
+		st.epoch = uint64(value)
+	}
+	return nil
+}
+
+/*****************************************************************************/
+
+// rollback removes a partially written record from the log. If the log cannot
+// be truncated, the store is marked as failed, and rejects the next records.
+func (st *Store) rollback(cause error) {
+
+	err := st.log.Truncate(st.size)
+	if err == nil {
+		_, err = st.log.Seek(st.size, io.SeekStart)
+	}
+	if err != nil {
+		st.failed = cause
+	}
+}
+
+/*****************************************************************************/
+
+// Sync flushes the log to the disk, if some records have been written since
+// the last call.
+func (st *Store) Sync() error {
+
+	if !st.dirty {
+		return nil
+	}
+	st.dirty = false
+	return st.log.Sync()
+}
+
+/*****************************************************************************/
+
+// Snapshot writes a new snapshot of the key/value pairs, and truncates the
+// log. The snapshot is written in a temporary file which is then renamed, so
+// a crash leaves either the previous snapshot or the new one. If the log is
+// not truncated because of a crash, its records are skipped at replay time
+// thanks to the sequence numbers.
+func (st *Store) Snapshot(stats map[string]int64) error {
+
+	// Nothing to do if no mutation has been logged since the last snapshot
+	if st.seq == st.snapSeq {
+		return nil
+	}
+
+	data, err := json.Marshal(&Snapshot{Seq: st.seq, Epoch: st.epoch, Stats: stats})
+	if err != nil {
+		return err
+	}
+	tmp := st.path("stats.snap.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, st.path("stats.snap"))
+	}
+	if err != nil {
+		return err
+	}
+	st.snapSeq = st.seq
+
+	// Compact the log
+	if err := st.log.Truncate(0); err != nil {
+		return err
+	}
+	_, err = st.log.Seek(0, io.SeekStart)
+	st.size, st.dirty = 0, false
+	return err
+}
+
+/*****************************************************************************/
+
+// Epoch returns the last fencing epoch which has been stored
+func (st *Store) Epoch() uint64 {
+	return st.epoch
+}
+
+/*****************************************************************************/
+
+// Close flushes and closes the log
+func (st *Store) Close() error {
+
+	if err := st.Sync(); err != nil {
+		st.log.Close()
+		return err
+	}
+	return st.log.Close()
+}
+
+/*****************************************************************************/
+
+// path returns the path of a persistence file
+func (st *Store) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+/*****************************************************************************/
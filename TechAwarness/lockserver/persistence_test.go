@@ -0,0 +1,130 @@
+package lockserver
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+/*****************************************************************************/
+
+func TestStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lockserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, stats, err := OpenStore(dir, SYNC_ALWAYS)
+	if err != nil || len(stats) != 0 {
+		t.Fatal("OpenStore failed", err)
+	}
+	st.Append("set", "toto", 10)
+	st.Append("incr", "toto", 5)
+	st.Append("incr", "tutu", -1)
+	st.Close()
+
+	// Replay the log
+	st, stats, err = OpenStore(dir, SYNC_ALWAYS)
+	if err != nil || stats["toto"] != 15 || stats["tutu"] != -1 {
+		t.Fatal("Replay failed", err, stats)
+	}
+
+	// Snapshot, and keep logging
+	stats["toto"] = 20
+	st.Append("set", "toto", 20)
+	if err := st.Snapshot(stats); err != nil {
+		t.Fatal(err)
+	}
+	st.Append("incr", "toto", 1)
+	st.Close()
+
+	// Simulate an interrupted write at the end of the log
+	log := filepath.Join(dir, "stats.log")
+	f, _ := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"Seq":99,"Op":"incr","Tar`)
+	f.Close()
+
+	st, stats, err = OpenStore(dir, SYNC_ALWAYS)
+	if err != nil || stats["toto"] != 21 || stats["tutu"] != -1 {
+		t.Fatal("Snapshot replay failed", err, stats)
+	}
+	st.Append("incr", "toto", 1)
+	st.Close()
+	st, stats, err = OpenStore(dir, SYNC_ALWAYS)
+	if err != nil || stats["toto"] != 22 {
+		t.Fatal("Truncated record not discarded", err, stats)
+	}
+	st.Close()
+}
+
+/*****************************************************************************/
+
+func TestStoreStaleLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lockserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, stats, _ := OpenStore(dir, SYNC_NEVER)
+	st.Append("incr", "toto", 1)
+	st.Append("incr", "toto", 1)
+	stats["toto"] = 2
+	st.Close()
+
+	// Crash between the snapshot and the log truncation: the records
+	// included in the snapshot must not be applied twice
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "stats.log"))
+	st, stats, _ = OpenStore(dir, SYNC_NEVER)
+	st.Snapshot(stats)
+	st.Close()
+	ioutil.WriteFile(filepath.Join(dir, "stats.log"), data, 0644)
+
+	st, stats, err = OpenStore(dir, SYNC_NEVER)
+	if err != nil || stats["toto"] != 2 {
+		t.Fatal("Stale records replayed", err, stats)
+	}
+	st.Close()
+}
+
+/*****************************************************************************/
+
+func TestStoreWriteError(t *testing.T) {
+
+	dir := t.TempDir()
+	st, _, _ := OpenStore(dir, SYNC_ALWAYS)
+	st.Append("set", "toto", 1)
+
+	// A failed write is not counted, and the store rejects the next records
+	// if the log cannot be restored
+	st.log.Close()
+	if err := st.Append("incr", "toto", 1); err == nil {
+		t.Fatal("Write error not reported")
+	}
+	if st.seq != 1 || st.size == 0 || st.failed == nil {
+		t.Error("Wrong store state", st.seq, st.size, st.failed)
+	}
+	if err := st.Append("incr", "toto", 1); err == nil {
+		t.Error("Failed store not reported")
+	}
+
+	// A corrupted last record is discarded at replay time
+	f, _ := os.OpenFile(filepath.Join(dir, "stats.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("{\"Seq\":2,\"Op\":\x00\x00\n")
+	f.Close()
+	st, stats, err := OpenStore(dir, SYNC_ALWAYS)
+	if err != nil || stats["toto"] != 1 {
+		t.Fatal("Torn record not discarded", err, stats)
+	}
+	st.Append("incr", "toto", 2)
+	st.Close()
+	st, stats, err = OpenStore(dir, SYNC_ALWAYS)
+	if err != nil || stats["toto"] != 3 || st.seq != 2 {
+		t.Fatal("Wrong replay", err, stats)
+	}
+	st.Close()
+}
+
+/*****************************************************************************/
@@ -0,0 +1,681 @@
+// This file contains a minimal implementation of the Raft consensus protocol,
+// used to replicate the core events in cluster mode.
+
+package lockserver
+
+import "encoding/json"
+import "math/rand"
+import "net"
+import "sync"
+import "time"
+
+/*****************************************************************************/
+
+const (
+	RAFT_FOLLOWER = iota
+	RAFT_CANDIDATE
+	RAFT_LEADER
+)
+
+const (
+	RAFT_VOTE = iota
+	RAFT_VOTE_REPLY
+	RAFT_APPEND
+	RAFT_APPEND_REPLY
+)
+
+const electionTicks = 10 // Minimum election timeout, in ticks
+const heartbeatTicks = 2 // Heartbeat period of the leader, in ticks
+const maxAppend = 64     // Maximum number of entries per append message
+const queueSize = 256    // Size of the outgoing message queue of each peer
+
+/*****************************************************************************/
+
+// Command is a core event replicated in the log of the cluster
+type Command struct {
+	Term   uint64        // Term of the leader which has accepted the event
+	Client string        // Cluster-wide id of the client, if any
+	Query  *MessageQuery // Event, without its client
+}
+
+// Entry is an entry of the replicated log
+type Entry struct {
+	Term    uint64
+	Command *Command
+}
+
+// raftMessage is the message exchanged between the nodes. Index and LogTerm
+// are the last log entry of the candidate for a vote, and the entry preceding
+// the new entries for an append. Index is the last matching entry in an
+// append reply.
+type raftMessage struct {
+	Type    int
+	From    int
+	Term    uint64
+	Index   uint64
+	LogTerm uint64
+	Entries []Entry `json:",omitempty"`
+	Commit  uint64
+	Leader  string `json:",omitempty"`
+	Success bool
+	to      int // Destination peer, not transmitted
+}
+
+// Role is the notification sent to the core when the role of the node or the
+// leader changes.
+type Role struct {
+	Leader     bool   // True if this node is the leader
+	Term       uint64 // Current term
+	LeaderAddr string // Client address of the leader, if known
+}
+
+/*****************************************************************************/
+
+// Raft is a node of the cluster. All the protocol state is managed by a
+// single goroutine, fed by the incoming messages, the proposals of the core
+// and a ticker. Committed entries are sent to the core in log order. The
+// messages produced by an event are only sent once the term, the vote and
+// the new entries are stored.
+type Raft struct {
+	id    int                 // Node id, index in peers
+	peers []string            // Raft addresses of all the nodes
+	addr  string              // Client address of this node, given to the followers
+	tick  time.Duration       // Tick period
+	core  *Core               // Core goroutine applying the entries
+	store *RaftStore          // Persistent state
+	recv  chan *raftMessage   // Incoming messages
+	outs  []chan *raftMessage // Outgoing messages, per peer
+	stop  chan bool           // Closed when the node is stopped
+	once  sync.Once           // Protects stop
+
+	mutex     sync.Mutex   // Protects proposals and conns
+	proposals []*Command   // Commands waiting to be appended
+	proposed  chan bool    // Signals new proposals
+	conns     []net.Conn   // Incoming connections
+	lis       net.Listener // Raft listener
+
+	state    int            // Follower, candidate or leader
+	term     uint64         // Current term
+	votedFor int            // Vote in the current term, -1 if none
+	log      []Entry        // Log, the first entry is a sentinel
+	commit   uint64         // Index of the last committed entry
+	applied  uint64         // Index of the last entry sent to the core
+	leader   int            // Current leader, -1 if unknown
+	leaderTo string         // Client address of the current leader
+	votes    map[int]bool   // Votes received by a candidate
+	next     []uint64       // Next entry to send, per peer (leader)
+	match    []uint64       // Last replicated entry, per peer (leader)
+	heard    map[int]bool   // Peers which have replied since the last check (leader)
+	elapsed  int            // Ticks since the last reset of the timer
+	timeout  int            // Randomized election timeout, in ticks
+	notified Role           // Last role notified to the core
+	stored   uint64         // Index of the last entry written to the store
+	pending  []*raftMessage // Messages waiting for the state to be stored
+}
+
+/*****************************************************************************/
+
+// NewRaft builds a Raft node, restoring the state loaded by the store
+func NewRaft(id int, peers []string, addr string, tick time.Duration, core *Core, store *RaftStore) *Raft {
+
+	r := &Raft{
+		id:       id,
+		peers:    peers,
+		addr:     addr,
+		tick:     tick,
+		core:     core,
+		store:    store,
+		recv:     make(chan *raftMessage, queueSize),
+		stop:     make(chan bool),
+		proposed: make(chan bool, 1),
+		term:     store.state.Term,
+		votedFor: store.state.VotedFor,
+		log:      store.entries,
+		leader:   -1,
+	}
+	r.stored = r.lastIndex()
+	for range peers {
+		r.outs = append(r.outs, make(chan *raftMessage, queueSize))
+	}
+	r.resetTimer()
+	return r
+}
+
+/*****************************************************************************/
+
+// Start spawns the goroutines of the node, using a listener bound to the
+// raft address of the node.
+func (r *Raft) Start(lis net.Listener) {
+
+	r.lis = lis
+	go r.accept()
+	for i := range r.peers {
+		if i != r.id {
+			go r.sender(i)
+		}
+	}
+	go r.run()
+}
+
+/*****************************************************************************/
+
+// Stop stops the node, and closes all its connections. It can be called
+// several times.
+func (r *Raft) Stop() {
+
+	r.once.Do(func() {
+		close(r.stop)
+		r.lis.Close()
+		r.mutex.Lock()
+		for _, c := range r.conns {
+			c.Close()
+		}
+		r.mutex.Unlock()
+	})
+}
+
+/*****************************************************************************/
+
+// Propose submits a command to the cluster. It never blocks. The command is
+// ignored if the node is not the leader anymore.
+func (r *Raft) Propose(cmd *Command) {
+
+	r.mutex.Lock()
+	r.proposals = append(r.proposals, cmd)
+	r.mutex.Unlock()
+	select {
+	case r.proposed <- true:
+	default:
+	}
+}
+
+/*****************************************************************************/
+
+// accept waits for the connections of the other nodes, and spawns a goroutine
+// decoding their messages.
+func (r *Raft) accept() {
+
+	for {
+		c, err := r.lis.Accept()
+		if err != nil {
+			return
+		}
+		r.mutex.Lock()
+		r.conns = append(r.conns, c)
+		r.mutex.Unlock()
+		go r.receiver(c)
+	}
+}
+
+/*****************************************************************************/
+
+// receiver decodes the messages of a connection, and forwards them to the
+// raft goroutine.
+func (r *Raft) receiver(c net.Conn) {
+
+	defer c.Close()
+	decoder := json.NewDecoder(c)
+	for {
+		m := &raftMessage{}
+		if err := decoder.Decode(m); err != nil {
+			return
+		}
+		select {
+		case r.recv <- m:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// sender writes the messages queued for a peer. The connection is
+// established on demand. Messages are dropped when the peer is unreachable:
+// the protocol recovers thanks to the periodic heartbeats.
+func (r *Raft) sender(peer int) {
+
+	var con net.Conn
+	var encoder *json.Encoder
+	defer func() {
+		if con != nil {
+			con.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case m := <-r.outs[peer]:
+			if con == nil {
+				c, err := net.DialTimeout("tcp", r.peers[peer], r.tick*electionTicks)
+				if err != nil {
+					continue
+				}
+				con, encoder = c, json.NewEncoder(c)
+			}
+			con.SetWriteDeadline(time.Now().Add(r.tick * electionTicks))
+			if err := encoder.Encode(m); err != nil {
+				con.Close()
+				con = nil
+			}
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// send prepares a message for a peer. It is queued by flush, once the state
+// of the node is stored.
+func (r *Raft) send(peer int, m *raftMessage) {
+
+	m.From, m.Term, m.to = r.id, r.term, peer
+	r.pending = append(r.pending, m)
+}
+
+/*****************************************************************************/
+
+// persist stores the term, the vote and the entries appended since the last
+// call
+func (r *Raft) persist() error {
+
+	if err := r.store.SaveState(RaftState{Term: r.term, VotedFor: r.votedFor}); err != nil {
+		return err
+	}
+	if err := r.store.Append(r.stored+1, r.log[r.stored+1:]); err != nil {
+		return err
+	}
+	r.stored = r.lastIndex()
+	return nil
+}
+
+/*****************************************************************************/
+
+// flush queues the pending messages, without blocking
+func (r *Raft) flush() {
+
+	for _, m := range r.pending {
+		select {
+		case r.outs[m.to] <- m:
+		default:
+		}
+	}
+	r.pending = nil
+}
+
+/*****************************************************************************/
+
+// run is the main event loop of the raft goroutine
+func (r *Raft) run() {
+
+	ticker := time.NewTicker(r.tick)
+	defer ticker.Stop()
+	defer r.store.Close()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case m := <-r.recv:
+			r.step(m)
+		case <-r.proposed:
+			r.appendProposals()
+		case <-ticker.C:
+			r.onTick()
+		}
+		if err := r.persist(); err != nil {
+			// The node cannot take part in the protocol anymore
+			r.core.log.Println("Raft store error", err)
+			r.Stop()
+			return
+		}
+		r.flush()
+		if !r.apply() {
+			return
+		}
+		r.notify()
+	}
+}
+
+/*****************************************************************************/
+
+// onTick manages election timeouts and heartbeats
+func (r *Raft) onTick() {
+
+	r.elapsed++
+	if r.state != RAFT_LEADER {
+		if r.elapsed >= r.timeout {
+			r.campaign()
+		}
+		return
+	}
+
+	if r.elapsed%heartbeatTicks == 0 {
+		r.broadcast()
+	}
+
+	// Step down if the majority cannot be reached anymore, so that the
+	// clients of a partitioned leader can find the new one.
+	if r.elapsed >= r.timeout {
+		if 2*(len(r.heard)+1) <= len(r.peers) {
+			r.core.log.Println("Leader has lost the majority")
+			r.becomeFollower(r.term, -1)
+			return
+		}
+		r.heard = make(map[int]bool)
+		r.elapsed = 0
+	}
+}
+
+/*****************************************************************************/
+
+// campaign starts an election
+func (r *Raft) campaign() {
+
+	r.state = RAFT_CANDIDATE
+	r.term++
+	r.votedFor = r.id
+	r.votes = map[int]bool{r.id: true}
+	r.leader, r.leaderTo = -1, ""
+	r.resetTimer()
+
+	last := r.lastIndex()
+	for i := range r.peers {
+		if i != r.id {
+			r.send(i, &raftMessage{Type: RAFT_VOTE, Index: last, LogTerm: r.log[last].Term})
+		}
+	}
+	r.countVotes()
+}
+
+/*****************************************************************************/
+
+// countVotes turns a candidate into a leader once it has the majority
+func (r *Raft) countVotes() {
+
+	if r.state == RAFT_CANDIDATE && 2*len(r.votes) > len(r.peers) {
+		r.becomeLeader()
+	}
+}
+
+/*****************************************************************************/
+
+// becomeLeader initializes the leader state. A leader entry is appended
+// immediately: it lets the core discard the clients of the previous leaders,
+// and commits the entries of the previous terms.
+func (r *Raft) becomeLeader() {
+
+	r.core.log.Println("Leader for term", r.term)
+	r.state = RAFT_LEADER
+	r.leader, r.leaderTo = r.id, r.addr
+	r.heard = make(map[int]bool)
+	r.elapsed = 0
+	r.next = make([]uint64, len(r.peers))
+	r.match = make([]uint64, len(r.peers))
+	for i := range r.peers {
+		r.next[i] = r.lastIndex() + 1
+	}
+	r.appendEntry(&Command{Term: r.term, Query: &MessageQuery{Op: "leader"}})
+}
+
+/*****************************************************************************/
+
+// becomeFollower moves to a new term, or recognizes a leader
+func (r *Raft) becomeFollower(term uint64, leader int) {
+
+	if term > r.term {
+		r.term = term
+		r.votedFor = -1
+	}
+	r.state = RAFT_FOLLOWER
+	if leader != r.leader {
+		r.leader, r.leaderTo = leader, ""
+	}
+	r.resetTimer()
+}
+
+/*****************************************************************************/
+
+// step processes an incoming message
+func (r *Raft) step(m *raftMessage) {
+
+	if m.Term > r.term {
+		r.becomeFollower(m.Term, -1)
+	}
+
+	switch m.Type {
+	case RAFT_VOTE:
+		// Vote for a candidate whose log is at least as up-to-date
+		last := r.lastIndex()
+		upToDate := m.LogTerm > r.log[last].Term || (m.LogTerm == r.log[last].Term && m.Index >= last)
+		grant := m.Term == r.term && (r.votedFor == -1 || r.votedFor == m.From) && upToDate
+		if grant {
+			r.votedFor = m.From
+			r.resetTimer()
+		}
+		r.send(m.From, &raftMessage{Type: RAFT_VOTE_REPLY, Success: grant})
+
+	case RAFT_VOTE_REPLY:
+		if m.Term == r.term && m.Success && r.state == RAFT_CANDIDATE {
+			r.votes[m.From] = true
+			r.countVotes()
+		}
+
+	case RAFT_APPEND:
+		r.handleAppend(m)
+
+	case RAFT_APPEND_REPLY:
+		if m.Term != r.term || r.state != RAFT_LEADER {
+			return
+		}
+		r.heard[m.From] = true
+		if m.Success {
+			if m.Index > r.match[m.From] {
+				r.match[m.From] = m.Index
+				r.next[m.From] = m.Index + 1
+				r.advanceCommit()
+			}
+		} else {
+			// Go back in the log of the follower
+			next := m.Index + 1
+			if next >= r.next[m.From] {
+				next = r.next[m.From] - 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			r.next[m.From] = next
+			r.sendAppend(m.From)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// handleAppend processes the entries (or heartbeat) sent by the leader
+func (r *Raft) handleAppend(m *raftMessage) {
+
+	if m.Term < r.term {
+		r.send(m.From, &raftMessage{Type: RAFT_APPEND_REPLY})
+		return
+	}
+	if r.state != RAFT_FOLLOWER || r.leader != m.From {
+		r.becomeFollower(m.Term, m.From)
+	}
+	r.leaderTo = m.Leader
+	r.resetTimer()
+
+	// The log must contain the entry preceding the new ones
+	last := r.lastIndex()
+	if m.Index > last || r.log[m.Index].Term != m.LogTerm {
+		hint := last
+		if m.Index <= last {
+			hint = m.Index - 1
+		}
+		r.send(m.From, &raftMessage{Type: RAFT_APPEND_REPLY, Index: hint})
+		return
+	}
+
+	// Append the new entries, removing the conflicting ones
+	for i, e := range m.Entries {
+		idx := m.Index + 1 + uint64(i)
+		if idx <= r.lastIndex() {
+			if r.log[idx].Term == e.Term {
+				continue
+			}
+			if idx <= r.commit {
+				// A committed entry is never replaced: the logs are
+				// inconsistent, and the append is rejected
+				r.core.log.Println("Raft log conflict on committed entry", idx)
+				r.send(m.From, &raftMessage{Type: RAFT_APPEND_REPLY, Index: idx - 1})
+				return
+			}
+			r.log = r.log[:idx]
+			if r.stored >= idx {
+				r.stored = idx - 1
+			}
+		}
+		r.log = append(r.log, e)
+	}
+
+	// The commit index never decreases: a stale leader message can carry
+	// a commit index lower than the local one
+	match := m.Index + uint64(len(m.Entries))
+	r.commit = max(r.commit, min(m.Commit, match))
+	r.send(m.From, &raftMessage{Type: RAFT_APPEND_REPLY, Index: match, Success: true})
+}
+
+/*****************************************************************************/
+
+// appendProposals appends the commands proposed by the core to the log
+func (r *Raft) appendProposals() {
+
+	r.mutex.Lock()
+	proposals := r.proposals
+	r.proposals = nil
+	r.mutex.Unlock()
+
+	if r.state != RAFT_LEADER {
+		return
+	}
+	for _, cmd := range proposals {
+		r.appendEntry(cmd)
+	}
+}
+
+/*****************************************************************************/
+
+// appendEntry appends a command to the log of the leader, and sends it to the
+// followers.
+func (r *Raft) appendEntry(cmd *Command) {
+
+	r.log = append(r.log, Entry{Term: r.term, Command: cmd})
+	r.match[r.id] = r.lastIndex()
+	r.advanceCommit()
+	r.broadcast()
+}
+
+/*****************************************************************************/
+
+// broadcast sends the missing entries (or a heartbeat) to all the followers
+func (r *Raft) broadcast() {
+
+	for i := range r.peers {
+		if i != r.id {
+			r.sendAppend(i)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// sendAppend sends the missing entries (or a heartbeat) to a follower
+func (r *Raft) sendAppend(peer int) {
+
+	prev := r.next[peer] - 1
+	end := r.lastIndex() + 1
+	if end > r.next[peer]+maxAppend {
+		end = r.next[peer] + maxAppend
+	}
+	entries := r.log[r.next[peer]:end]
+	r.send(peer, &raftMessage{
+		Type:    RAFT_APPEND,
+		Index:   prev,
+		LogTerm: r.log[prev].Term,
+		Entries: entries,
+		Commit:  r.commit,
+		Leader:  r.addr,
+	})
+}
+
+/*****************************************************************************/
+
+// advanceCommit commits the entries of the current term which are stored on
+// a majority of nodes.
+func (r *Raft) advanceCommit() {
+
+	for n := r.lastIndex(); n > r.commit && r.log[n].Term == r.term; n-- {
+		count := 0
+		for i := range r.peers {
+			if r.match[i] >= n {
+				count++
+			}
+		}
+		if 2*count > len(r.peers) {
+			r.commit = n
+			return
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// apply sends the newly committed entries to the core. It returns false if
+// the node has been stopped meanwhile.
+func (r *Raft) apply() bool {
+
+	for r.applied < r.commit {
+		r.applied++
+		select {
+		case r.core.in <- &MessageQuery{oper: OP_COMMIT, command: r.log[r.applied].Command}:
+		case <-r.stop:
+			return false
+		}
+	}
+	return true
+}
+
+/*****************************************************************************/
+
+// notify sends the role of the node to the core when it has changed
+func (r *Raft) notify() {
+
+	role := Role{Leader: r.state == RAFT_LEADER, Term: r.term, LeaderAddr: r.leaderTo}
+	if role == r.notified {
+		return
+	}
+	r.notified = role
+	select {
+	case r.core.in <- &MessageQuery{oper: OP_ROLE, role: &role}:
+	case <-r.stop:
+	}
+}
+
+/*****************************************************************************/
+
+// resetTimer restarts the election timer with a random timeout
+func (r *Raft) resetTimer() {
+
+	r.elapsed = 0
+	r.timeout = electionTicks + rand.Intn(electionTicks)
+}
+
+/*****************************************************************************/
+
+// lastIndex returns the index of the last log entry
+func (r *Raft) lastIndex() uint64 {
+	return uint64(len(r.log) - 1)
+}
+
+/*****************************************************************************/
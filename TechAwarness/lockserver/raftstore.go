@@ -0,0 +1,190 @@
+// This file contains the persistence of the Raft state. A node must not
+// forget its term, its vote or the entries it has acknowledged, otherwise a
+// restarted node could vote twice in a term, or drop committed entries. The
+// log is never compacted (see the package documentation).
+
+package lockserver
+
+import "bufio"
+import "encoding/json"
+import "errors"
+import "io"
+import "os"
+import "path/filepath"
+
+/*****************************************************************************/
+
+// RaftState is the content of the Raft state file (raft.state): the current
+// term and the vote of the node in this term (-1 if none), e.g.:
+//
+//	{"Term":7,"VotedFor":2}
+type RaftState struct {
+	Term     uint64
+	VotedFor int
+}
+
+// RaftRecord is an entry of the Raft log file (raft.log), with its index.
+// The log is a text file containing one JSON record per line. A record whose
+// index is not greater than the previous one replaces the entries from this
+// index, as when a follower removes some conflicting entries.
+type RaftRecord struct {
+	Index uint64
+	Entry
+}
+
+/*****************************************************************************/
+
+// RaftStore is the persistence layer of a Raft node. The state file is
+// replaced atomically, and the log is only appended. Both are fsynced before
+// the node sends the messages depending on them. It is only used by the raft
+// goroutine.
+type RaftStore struct {
+	dir     string        // Persistence directory
+	log     *os.File      // Log file
+	encoder *json.Encoder // Record encoder writing to the log
+	state   RaftState     // Last stored state
+	entries []Entry       // Entries loaded from the log, the first one is a sentinel
+}
+
+/*****************************************************************************/
+
+// OpenRaftStore opens the Raft files of a directory, creating them if needed.
+// The state is loaded, and the log replayed. An incomplete or corrupted record
+// at the end of the log (interrupted write) is discarded.
+func OpenRaftStore(dir string) (*RaftStore, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	st := &RaftStore{dir: dir, state: RaftState{VotedFor: -1}, entries: []Entry{{}}}
+
+	// Load the state
+	if data, err := os.ReadFile(st.path("raft.state")); err == nil {
+		if err := json.Unmarshal(data, &st.state); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Replay the log
+	f, err := os.OpenFile(st.path("raft.log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := st.replay(f)
+	if err == nil {
+		// Discard an incomplete record, and append the next ones
+		if err = f.Truncate(valid); err == nil {
+			_, err = f.Seek(valid, io.SeekStart)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st.log = f
+	st.encoder = json.NewEncoder(f)
+	return st, nil
+}
+
+/*****************************************************************************/
+
+// replay loads the entries of the log. It returns the size of the valid part
+// of the log.
+func (st *RaftStore) replay(f *os.File) (int64, error) {
+
+	reader := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Only complete lines are considered
+			return valid, nil
+		} else if err != nil {
+			return 0, err
+		}
+		r := &RaftRecord{}
+		if err := json.Unmarshal(line, r); err != nil {
+			// Only the last record can be torn by a crash
+			if _, err := reader.Peek(1); err == io.EOF {
+				return valid, nil
+			}
+			return 0, errors.New("Corrupted Raft record: " + string(line))
+		}
+		if r.Index == 0 || r.Index > uint64(len(st.entries)) {
+			return 0, errors.New("Unexpected Raft record: " + string(line))
+		}
+		valid += int64(len(line))
+		st.entries = append(st.entries[:r.Index], r.Entry)
+	}
+}
+
+/*****************************************************************************/
+
+// SaveState stores the term and the vote of the node, if they have changed.
+// The state is written in a temporary file which is then renamed, so a crash
+// leaves either the previous state or the new one.
+func (st *RaftStore) SaveState(state RaftState) error {
+
+	if state == st.state {
+		return nil
+	}
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	tmp := st.path("raft.state.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, st.path("raft.state"))
+	}
+	if err != nil {
+		return err
+	}
+	st.state = state
+	return nil
+}
+
+/*****************************************************************************/
+
+// Append writes some entries to the log, the first one at the given index,
+// and flushes the log to the disk.
+func (st *RaftStore) Append(index uint64, entries []Entry) error {
+
+	if len(entries) == 0 {
+		return nil
+	}
+	for i, e := range entries {
+		if err := st.encoder.Encode(&RaftRecord{Index: index + uint64(i), Entry: e}); err != nil {
+			return err
+		}
+	}
+	return st.log.Sync()
+}
+
+/*****************************************************************************/
+
+// Close closes the log
+func (st *RaftStore) Close() error {
+	return st.log.Close()
+}
+
+/*****************************************************************************/
+
+// path returns the path of a Raft file
+func (st *RaftStore) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,51 @@
+package lockserver
+
+import "os"
+import "path/filepath"
+import "testing"
+
+/*****************************************************************************/
+
+func TestRaftStore(t *testing.T) {
+
+	dir := t.TempDir()
+	st, err := OpenRaftStore(dir)
+	if err != nil || st.state != (RaftState{VotedFor: -1}) || len(st.entries) != 1 {
+		t.Fatal("OpenRaftStore failed", err)
+	}
+	entry := func(term uint64, op string) Entry {
+		return Entry{Term: term, Command: &Command{Term: term, Query: &MessageQuery{Op: op}}}
+	}
+	st.SaveState(RaftState{Term: 2, VotedFor: 1})
+	st.Append(1, []Entry{entry(1, "set"), entry(2, "incr"), entry(2, "lock")})
+
+	// Conflicting entries replaced by a follower
+	st.Append(3, []Entry{entry(3, "unlock")})
+	st.Close()
+
+	// Simulate an interrupted write at the end of the log
+	f, _ := os.OpenFile(filepath.Join(dir, "raft.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"Index":4,"Term":3,"Comm`)
+	f.Close()
+
+	st, err = OpenRaftStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.state != (RaftState{Term: 2, VotedFor: 1}) {
+		t.Error("Wrong state", st.state)
+	}
+	if len(st.entries) != 4 || st.entries[2].Command.Query.Op != "incr" || st.entries[3].Term != 3 || st.entries[3].Command.Query.Op != "unlock" {
+		t.Fatal("Wrong entries", st.entries)
+	}
+	st.Append(4, []Entry{entry(3, "get")})
+	st.Close()
+
+	st, err = OpenRaftStore(dir)
+	if err != nil || len(st.entries) != 5 || st.entries[4].Command.Query.Op != "get" {
+		t.Fatal("Truncated record not discarded", err, st.entries)
+	}
+	st.Close()
+}
+
+/*****************************************************************************/
@@ -0,0 +1,302 @@
+// This file contains the primary/backup replication code.
+
+package lockserver
+
+import "encoding/json"
+import "errors"
+import "log"
+import "net"
+import "strconv"
+import "time"
+
+/*****************************************************************************/
+
+// Replica represents a follower connected to the replication port of a
+// primary server. The core pushes the state changes to the replica, which
+// writes them to the connection as a stream of JSON records (see Record).
+//
+// The stream starts with the current state (epoch, reset, and one set record
+// per key), followed by the set and incr records in the order they are
+// applied by the core. The lock data structure is not replicated: on
+// promotion, all the locks are considered as lost, and a new fencing epoch is
+// started.
+type Replica struct {
+	con   net.Conn     // TCP connection
+	out   chan *Record // Record channel (to be used by the core)
+	state *Snapshot    // Copy of the state when the follower has connected
+	log   *log.Logger  // Logger of the server
+	core  *Core        // Core pushing the records
+}
+
+/*****************************************************************************/
+
+// NewReplica builds a Replica structure, with a record channel of the given
+// size
+func NewReplica(con net.Conn, size int, logger *log.Logger) *Replica {
+	return &Replica{con: con, out: make(chan *Record, size), log: logger}
+}
+
+/*****************************************************************************/
+
+// recordOut is waiting for records from the core, encode them in JSON, and
+// write them to the follower socket. After a write error, the core is asked
+// to remove the replica.
+func (rep *Replica) recordOut() {
+
+	// Be sure the connection is closed in the end
+	defer rep.con.Close()
+
+	// Send the initial state, then the changes
+	encoder := json.NewEncoder(rep.con)
+	records := []*Record{{Op: "epoch", Value: int64(rep.state.Epoch)}, {Op: "reset"}}
+	for k, v := range rep.state.Stats {
+		records = append(records, &Record{Op: "set", Target: k, Value: v})
+	}
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			rep.fail(err)
+			return
+		}
+	}
+	for r := range rep.out {
+		if err := encoder.Encode(r); err != nil {
+			rep.fail(err)
+			return
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// fail logs a write error, and notifies the core
+func (rep *Replica) fail(err error) {
+
+	rep.log.Println("Error ", err)
+	rep.core.send(&MessageQuery{oper: OP_DETACH, replica: rep})
+}
+
+/*****************************************************************************/
+
+// ServeReplication accepts the connections of the followers, until the
+// listener is closed
+func (core *Core) ServeReplication(lis net.Listener) {
+
+	core.log.Printf("Replicating to %s\n", lis.Addr())
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				core.log.Println(err)
+			}
+			return
+		}
+		core.send(&MessageQuery{oper: OP_REPLICA, replica: NewReplica(c, cap(core.in), core.log)})
+	}
+}
+
+/*****************************************************************************/
+
+// Follower is the goroutine receiving the state changes from a primary
+// server, and forwarding them to the core.
+type Follower struct {
+	primary string    // Replication address of the primary
+	core    *Core     // Shortcut to the core goroutine
+	stop    chan bool // Closed when the follower is promoted
+	broken  net.Conn  // Connection whose records are ignored after an error (used by the core)
+}
+
+/*****************************************************************************/
+
+// NewFollower builds a Follower structure. The core only serves read-only
+// operations until it is promoted.
+func NewFollower(primary string, core *Core) *Follower {
+	fo := &Follower{primary: primary, core: core, stop: make(chan bool)}
+	core.follower = fo
+	return fo
+}
+
+/*****************************************************************************/
+
+// follow connects to the primary, and keeps receiving records. The
+// connection is retried every second until the follower is promoted, or the
+// core is stopped. Each new connection starts with a full state transfer.
+func (fo *Follower) follow() {
+
+	for {
+		if con, err := net.Dial("tcp", fo.primary); err != nil {
+			fo.core.log.Println("Error ", err)
+		} else {
+			fo.core.log.Printf("Following %s\n", fo.primary)
+			fo.recordIn(con)
+		}
+		select {
+		case <-fo.stop:
+			return
+		case <-fo.core.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// recordIn decodes the records from the primary, and sends them to the core
+func (fo *Follower) recordIn(con net.Conn) {
+
+	// Be sure the connection is closed on promotion, on stop, or on error
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-fo.stop:
+		case <-fo.core.done:
+		case <-done:
+		}
+		con.Close()
+	}()
+
+	decoder := json.NewDecoder(con)
+	for {
+		r := &Record{}
+		if err := decoder.Decode(r); err != nil {
+			fo.core.log.Println("Replication stopped:", err)
+			return
+		}
+		fo.core.send(&MessageQuery{oper: OP_APPLY, record: r, link: con})
+	}
+}
+
+/*****************************************************************************/
+
+// handleReplica registers a new follower. A copy of the current state is
+// given to the replica goroutine, which sends it before the next changes.
+func (core *Core) handleReplica(query *MessageQuery) {
+
+	rep := query.replica
+	core.log.Println("New follower", rep.con.RemoteAddr())
+	rep.state = &Snapshot{Epoch: core.locks.epoch, Stats: make(map[string]int64, len(core.stats))}
+	for k, v := range core.stats {
+		rep.state.Stats[k] = v
+	}
+	rep.core = core
+	core.replicas[rep] = true
+	go rep.recordOut()
+}
+
+/*****************************************************************************/
+
+// handleDetach removes a follower whose connection has failed, unless it has
+// already been disconnected
+func (core *Core) handleDetach(query *MessageQuery) {
+
+	rep := query.replica
+	if core.replicas[rep] {
+		core.log.Println("Follower disconnected", rep.con.RemoteAddr())
+		core.detach(rep)
+	}
+}
+
+/*****************************************************************************/
+
+// detach stops pushing the records to a follower, and closes its connection
+func (core *Core) detach(rep *Replica) {
+
+	delete(core.replicas, rep)
+	close(rep.out)
+	rep.con.Close()
+}
+
+/*****************************************************************************/
+
+// handleApply applies a record received from the primary. It is also
+// persisted, and forwarded to the followers of this server, if any. If the
+// record cannot be persisted, the connection to the primary is closed, so that
+// the next connection starts again with a full state transfer.
+func (core *Core) handleApply(query *MessageQuery) {
+
+	// Records still queued after a promotion, or after an error on the same
+	// connection, are ignored
+	fo := core.follower
+	if fo == nil || (query.link != nil && query.link == fo.broken) {
+		return
+	}
+
+	r := query.record
+	if !core.persist(r.Op, r.Target, r.Value) {
+		core.log.Println("Cannot persist replicated record, resynchronizing")
+		if query.link != nil {
+			fo.broken = query.link
+			query.link.Close()
+		}
+		return
+	}
+	switch r.Op {
+	case "set":
+		core.stats[r.Target] = r.Value
+		core.publish(r.Target)
+	case "incr":
+		core.stats[r.Target] += r.Value
+		core.publish(r.Target)
+	case "reset":
+		core.stats = make(map[string]int64)
+	case "epoch":
+		core.locks.SetEpoch(uint64(r.Value))
+	}
+	core.replicate(r)
+}
+
+/*****************************************************************************/
+
+// handlePromote turns a follower into a primary server. The lock data
+// structure is not replicated, so the locks granted by the previous primary
+// are considered as lost, and a new fencing epoch is started: the tokens
+// granted from now on are greater than any token granted by the previous
+// primary.
+func (core *Core) handlePromote(query *MessageQuery) {
+
+	if core.follower == nil {
+		query.reply(&MessageReply{Status: "KO", Error: "Not a follower"})
+		return
+	}
+	close(core.follower.stop)
+	core.follower = nil
+
+	epoch := core.nextEpoch()
+	core.log.Println("Promoted, epoch", epoch)
+	query.reply(&MessageReply{Status: "OK", Value: strconv.FormatUint(epoch, 10)})
+}
+
+/*****************************************************************************/
+
+// nextEpoch starts a new fencing epoch, and persists and replicates it
+func (core *Core) nextEpoch() uint64 {
+
+	epoch := core.locks.epoch + 1
+	if core.store != nil && core.store.Epoch() >= epoch {
+		epoch = core.store.Epoch() + 1
+	}
+	core.persist("epoch", "", int64(epoch))
+	core.locks.SetEpoch(epoch)
+	core.replicate(&Record{Op: "epoch", Value: int64(epoch)})
+	return epoch
+}
+
+/*****************************************************************************/
+
+// replicate pushes a record to all the followers. The core never waits for
+// a follower: if its channel is full, it is disconnected, and it will get the
+// whole state again when it reconnects.
+func (core *Core) replicate(r *Record) {
+
+	for rep := range core.replicas {
+		select {
+		case rep.out <- r:
+		default:
+			core.log.Println("Follower too slow, disconnecting", rep.con.RemoteAddr())
+			core.detach(rep)
+		}
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,219 @@
+package lockserver
+
+import "io"
+import "log"
+import "net"
+import "os/exec"
+import "strconv"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// waitValue polls a value until it reaches the expected one
+func waitValue(t *testing.T, c *replier, target string, expected string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		c.send("get", target, "")
+		if c.expect(t, "OK").Value == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Value not replicated", target)
+}
+
+/*****************************************************************************/
+
+func TestReplication(t *testing.T) {
+
+	// Primary server, with some state before the follower connects
+	primary := startCore()
+	primary.locks.SetEpoch(3)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go primary.ServeReplication(lis)
+	p := newReplier(primary)
+	p.send("set", "toto", "10")
+	p.expect(t, "OK")
+
+	// Follower server, connected through the loopback interface
+	follower := NewCore(DefaultOptions())
+	go NewFollower(lis.Addr().String(), follower).follow()
+	go follower.main()
+	f := newReplier(follower)
+	waitValue(t, f, "toto", "10")
+
+	p.send("incr", "toto", "5")
+	p.expect(t, "OK")
+	p.send("set", "tutu", "1")
+	p.expect(t, "OK")
+	waitValue(t, f, "toto", "15")
+	waitValue(t, f, "tutu", "1")
+
+	// The follower is read-only
+	f.send("incr", "toto", "1")
+	if m := f.expect(t, "KO"); m.Error != "Read-only follower" {
+		t.Error("Wrong error", m.Error)
+	}
+	f.send("lock", "toto", "")
+	f.expect(t, "KO")
+
+	// Promotion: the new tokens are greater than the tokens of the primary
+	p.send("lock", "titi", "")
+	old, _ := strconv.ParseUint(p.expect(t, "OK").Value, 10, 64)
+	f.send("promote", "", "")
+	if m := f.expect(t, "KO"); m.Error != "Permission denied" {
+		t.Error("Wrong error", m.Error)
+	}
+	f.admin("promote")
+	if m := f.expect(t, "OK"); m.Value != "4" {
+		t.Error("Wrong epoch", m.Value)
+	}
+	f.send("lock", "titi", "")
+	if n, _ := strconv.ParseUint(f.expect(t, "OK").Value, 10, 64); n <= old {
+		t.Error("Token not increased", n, old)
+	}
+	f.send("incr", "toto", "1")
+	if m := f.expect(t, "OK"); m.Value != "16" {
+		t.Error("Wrong value", m.Value)
+	}
+
+	// The changes of the old primary are not applied anymore
+	p.send("set", "tutu", "2")
+	p.expect(t, "OK")
+	time.Sleep(50 * time.Millisecond)
+	waitValue(t, f, "tutu", "1")
+	f.admin("promote")
+	f.expect(t, "KO")
+}
+
+/*****************************************************************************/
+
+func TestReplicaDetach(t *testing.T) {
+
+	// The core is not running: its events are read by the test
+	core := NewCore(DefaultOptions())
+	c1, c2 := net.Pipe()
+	rep := NewReplica(c1, 8, log.New(io.Discard, "", 0))
+	core.handleReplica(&MessageQuery{oper: OP_REPLICA, replica: rep})
+
+	// The follower disconnects: the core is asked to remove the replica
+	c2.Close()
+	select {
+	case m := <-core.in:
+		if m.oper != OP_DETACH || m.replica != rep {
+			t.Fatal("Wrong event", m.oper)
+		}
+		core.dispatch(m)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Replica not detached")
+	}
+	if len(core.replicas) != 0 {
+		t.Error("Replica not removed")
+	}
+	core.replicate(&Record{Op: "set", Target: "toto", Value: 1})
+}
+
+/*****************************************************************************/
+
+func TestReplicaPersistError(t *testing.T) {
+
+	// The core is not running: the records are applied by the test
+	core := NewCore(DefaultOptions())
+	NewFollower("", core)
+	st, _, err := OpenStore(t.TempDir(), SYNC_ALWAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.store = st
+	st.log.Close()
+	c1, c2 := net.Pipe()
+	apply := func(con net.Conn, value int64) {
+		core.handleApply(&MessageQuery{oper: OP_APPLY, record: &Record{Op: "set", Target: "toto", Value: value}, link: con})
+	}
+
+	// A record which cannot be persisted is not applied, and the connection
+	// to the primary is closed
+	apply(c1, 1)
+	if _, ok := core.stats["toto"]; ok {
+		t.Error("Record applied")
+	}
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Connection not closed", err)
+	}
+
+	// The next records of this connection are ignored, but not the records
+	// of the next connection
+	core.store = nil
+	apply(c1, 2)
+	if _, ok := core.stats["toto"]; ok {
+		t.Error("Record applied after the error")
+	}
+	c3, _ := net.Pipe()
+	apply(c3, 3)
+	if core.stats["toto"] != 3 {
+		t.Error("Record not applied", core.stats["toto"])
+	}
+}
+
+/*****************************************************************************/
+
+func TestReplicationProcesses(t *testing.T) {
+
+	_, bin := buildLockctl(t)
+
+	// A primary and a follower on the loopback interface
+	addrs := freeAddrs(t, 4)
+	primary, follower, replication, admin := addrs[0], addrs[1], addrs[2], addrs[3]
+	var procs []*exec.Cmd
+	start := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(bin, append([]string{"-l", "-monitor", ""}, args...)...)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		procs = append(procs, cmd)
+		return cmd
+	}
+	defer func() {
+		for _, cmd := range procs {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+	p := start("-s", primary, "-r", replication)
+	start("-s", follower, "-f", replication, "-admin", admin)
+
+	// wait polls a server until a query gets the expected reply
+	wait := func(addr string, q *MessageQuery, status string, value string) {
+		t.Helper()
+		var m *MessageReply
+		for i := 0; i < 200; i++ {
+			if m = query(addr, q); m != nil && m.Status == status && m.Value == value {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("Unexpected reply", q.Op, m)
+	}
+	wait(primary, &MessageQuery{Op: "set", Target: "toto", Arg: "10"}, "OK", "")
+	wait(primary, &MessageQuery{Op: "incr", Target: "toto", Arg: "5"}, "OK", "15")
+	wait(follower, &MessageQuery{Op: "get", Target: "toto"}, "OK", "15")
+	if m := query(follower, &MessageQuery{Op: "incr", Target: "toto", Arg: "1"}); m == nil || m.Error != "Read-only follower" {
+		t.Error("Wrong reply", m)
+	}
+
+	// Kill the primary, and promote the follower on its administration port
+	p.Process.Kill()
+	p.Wait()
+	if m := query(follower, &MessageQuery{Op: "promote"}); m == nil || m.Error != "Permission denied" {
+		t.Error("Wrong reply", m)
+	}
+	wait(admin, &MessageQuery{Op: "promote"}, "OK", "1")
+	wait(follower, &MessageQuery{Op: "incr", Target: "toto", Arg: "1"}, "OK", "16")
+}
+
+/*****************************************************************************/
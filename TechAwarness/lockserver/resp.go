@@ -0,0 +1,309 @@
+// This file contains the Redis protocol (RESP) front-end. The commands of the
+// Redis clients are converted into queries, processed by the core like the
+// JSON ones, and the replies are encoded back in RESP.
+
+package lockserver
+
+import "bufio"
+import "errors"
+import "io"
+import "net"
+import "strconv"
+import "strings"
+import "sync/atomic"
+import "time"
+
+/*****************************************************************************/
+
+const maxRespArgs = 1024      // Maximum number of arguments of a command
+const maxRespBulk = 64 * 1024 // Maximum size of an argument
+
+var errProtocol = errors.New("Protocol error")
+
+// respArity gives the number of arguments of the supported commands,
+// including the command name. A negative arity is a minimum, with one more
+// optional argument.
+var respArity = map[string]int{
+	"get":     2,
+	"set":     3,
+	"incr":    2,
+	"incrby":  3,
+	"lock":    -2,
+	"trylock": 2,
+	"unlock":  2,
+	"ping":    1,
+	"quit":    1,
+	"auth":    -2,
+}
+
+/*****************************************************************************/
+
+// RespClient represents a client connection using the Redis protocol
+type RespClient struct {
+	con      net.Conn           // TCP connection
+	router   *Router            // Shortcut to the core shards
+	coreOut  chan *MessageReply // Reply channel (to be used by the core)
+	id       uint64             // Connection id
+	since    time.Time          // Connection time
+	commands int64              // Number of commands received
+	user     *User              // Authenticated user, nil until the AUTH command
+	draining int32              // Set to stop reading the commands, at shutdown
+	slow     int32              // Set once disconnected as a slow consumer
+}
+
+/*****************************************************************************/
+
+// NewRespClient construct a RespClient structure
+func NewRespClient(con net.Conn, router *Router) *RespClient {
+	channel := router.newQueue()
+	return &RespClient{con: con, router: router, coreOut: channel, id: router.nextId(), since: time.Now()}
+}
+
+/*****************************************************************************/
+
+// String returns the remote address of the client
+func (clt *RespClient) String() string {
+	return clt.con.RemoteAddr().String()
+}
+
+/*****************************************************************************/
+
+// Reply is used by the core methods to return a reply to the client. It
+// never blocks: a client which does not read its replies is disconnected.
+func (clt *RespClient) Reply(r *MessageReply) {
+	clt.router.push(clt, clt.coreOut, &clt.slow, r)
+}
+
+/*****************************************************************************/
+
+// Info describes the connection, for the administration operations
+func (clt *RespClient) Info() *ClientInfo {
+	return &ClientInfo{Id: clt.id, Addr: clt.String(), Since: clt.since, Commands: atomic.LoadInt64(&clt.commands)}
+}
+
+/*****************************************************************************/
+
+// Kill closes the connection. The reading goroutine then notifies the shards.
+func (clt *RespClient) Kill() {
+	clt.con.Close()
+}
+
+/*****************************************************************************/
+
+// Drain stops reading the commands. The connection is closed once the replies
+// of the shards are written.
+func (clt *RespClient) Drain() {
+
+	atomic.StoreInt32(&clt.draining, 1)
+	clt.con.SetReadDeadline(time.Now())
+}
+
+/*****************************************************************************/
+
+// respIn reads the commands from the client socket, converts them into
+// queries, and sends them to the core shards. The queries are always
+// numbered, since some commands are answered without the core.
+func (clt *RespClient) respIn() {
+
+	// Be sure the shards are notified when connection is closed
+	defer clt.router.broadcast(&MessageQuery{clt: clt, oper: OP_CLOSE})
+
+	// Identify the client by its certificate, if any
+	if auth := clt.router.auth; auth != nil {
+		clt.user = certUser(clt.con, auth)
+	}
+	reader := bufio.NewReader(clt.con)
+	clt.router.broadcast(&MessageQuery{clt: clt, oper: OP_OPEN})
+
+	seq := uint64(0)
+	for {
+		// Read the next command, skipping empty lines
+		args, err := readCommand(reader)
+		if err == io.EOF || atomic.LoadInt32(&clt.draining) != 0 {
+			break
+		} else if err == nil && len(args) == 0 {
+			continue
+		}
+		seq++
+		atomic.AddInt64(&clt.commands, 1)
+		m := &MessageQuery{clt: clt, seq: seq, ordered: true}
+		if err != nil {
+			// Decoding error: reply, and close the connection
+			m.reply(&MessageReply{Status: "KO", Error: err.Error()})
+			break
+		}
+
+		// Convert the command, or reply directly
+		if reply := parseCommand(args, m); reply != nil {
+			m.reply(reply)
+			if m.Op == "quit" {
+				break
+			}
+			continue
+		}
+		m.oper = Service[m.Op]
+		if auth := clt.router.auth; auth != nil {
+			if reply := auth.authorize(&clt.user, m); reply != nil {
+				m.reply(reply)
+				continue
+			}
+		}
+		clt.router.route(m)
+	}
+}
+
+/*****************************************************************************/
+
+// respOut encodes the replies of the core in RESP, and writes them to the
+// client socket. The socket is flushed when no other reply is pending.
+func (clt *RespClient) respOut() {
+
+	// Be sure the connection is closed in the end
+	defer clt.router.untrack(clt)
+	defer clt.con.Close()
+
+	writer := bufio.NewWriter(clt.con)
+	end := false
+	clt.router.deliver(clt.coreOut, func(reply *MessageReply) {
+		// Ignore all messages after a write error, and the notifications,
+		// which have no RESP equivalent
+		if end || reply.Event != "" {
+			return
+		}
+		clt.router.deadline(clt.con)
+		writeReply(writer, reply)
+	}, func() {
+		if !end && writer.Buffered() > 0 {
+			clt.router.deadline(clt.con)
+			if err := writer.Flush(); err != nil {
+				clt.router.writeFailed(clt, &clt.slow, err)
+				end = true
+			}
+		}
+	})
+	writer.Flush()
+}
+
+/*****************************************************************************/
+
+// parseCommand converts a Redis command into a query. It returns a reply
+// if the command is answered without the core.
+func parseCommand(args []string, m *MessageQuery) *MessageReply {
+
+	name := strings.ToLower(args[0])
+	n, ok := respArity[name]
+	switch {
+	case !ok:
+		return &MessageReply{Status: "KO", Error: "unknown command '" + args[0] + "'"}
+	case (n > 0 && len(args) != n) || (n < 0 && (len(args) < -n || len(args) > 1-n)):
+		return &MessageReply{Status: "KO", Error: "wrong number of arguments for '" + args[0] + "' command"}
+	}
+
+	m.Op = name
+	switch name {
+	case "ping":
+		return &MessageReply{Status: "OK", Value: "PONG"}
+	case "quit":
+		return &MessageReply{Status: "OK"}
+	case "set":
+		m.Arg = args[2]
+	case "incr":
+		m.Arg = "1"
+	case "incrby":
+		m.Op, m.Arg = "incr", args[2]
+	case "lock":
+		// Optional timeout
+		if len(args) == 3 {
+			m.Arg = args[2]
+		}
+	case "auth":
+		// AUTH [username] password, the default user being "default"
+		m.Target, m.Arg = "default", args[len(args)-1]
+		if len(args) == 3 {
+			m.Target = args[1]
+		}
+		return nil
+	}
+	m.Target = args[1]
+	return nil
+}
+
+/*****************************************************************************/
+
+// readCommand reads a command, either as an array of bulk strings, or as an
+// inline command.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxRespArgs {
+		return nil, errProtocol
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRespBulk {
+			return nil, errProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+/*****************************************************************************/
+
+// readLine reads a line terminated by CRLF (or LF), without its terminator
+func readLine(reader *bufio.Reader) (string, error) {
+
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/*****************************************************************************/
+
+// writeReply encodes a reply in RESP. Errors are returned with the ERR
+// prefix, the incr results as integers, and the other values as bulk
+// strings.
+func writeReply(writer *bufio.Writer, r *MessageReply) {
+
+	switch {
+	case r.Status != "OK":
+		msg := r.Error
+		if r.Value != "" {
+			msg += ": " + r.Value
+		}
+		writer.WriteString("-ERR " + msg + "\r\n")
+	case r.oper == OP_INCR:
+		writer.WriteString(":" + r.Value + "\r\n")
+	case r.Value == "":
+		writer.WriteString("+OK\r\n")
+	default:
+		writer.WriteString("$" + strconv.Itoa(len(r.Value)) + "\r\n" + r.Value + "\r\n")
+	}
+}
+
+/*****************************************************************************/
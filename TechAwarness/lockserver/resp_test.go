@@ -0,0 +1,168 @@
+package lockserver
+
+import "bufio"
+import "net"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// respPipe connects a Redis client to the shards through an in-memory
+// connection, and returns functions to send raw commands and read lines
+func respPipe(t *testing.T, router *Router) (func(string), func() string, net.Conn) {
+
+	c1, c2 := net.Pipe()
+	clt := NewRespClient(c1, router)
+	go clt.respIn()
+	go clt.respOut()
+	reader := bufio.NewReader(c2)
+	send := func(cmd string) {
+		go c2.Write([]byte(cmd))
+	}
+	read := func() string {
+		t.Helper()
+		c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line[:len(line)-2]
+	}
+	return send, read, c2
+}
+
+/*****************************************************************************/
+
+func TestResp(t *testing.T) {
+
+	router := startShards(2)
+	send, read, con := respPipe(t, router)
+	send2, read2, con2 := respPipe(t, router)
+
+	expect := func(read func() string, lines ...string) {
+		t.Helper()
+		for _, l := range lines {
+			if got := read(); got != l {
+				t.Fatalf("Expected %q, got %q", l, got)
+			}
+		}
+	}
+
+	// Values, with array and inline commands
+	send("*3\r\n$3\r\nSET\r\n$4\r\ntoto\r\n$2\r\n10\r\n")
+	expect(read, "+OK")
+	send("INCRBY toto 5\r\nincr titi\r\nGET toto\r\n")
+	expect(read, ":15", ":1", "$2", "15")
+	send("SET toto abc\r\n")
+	expect(read, "-ERR Invalid number")
+
+	// Local replies stay in order
+	send("PING\r\nFOO\r\nGET\r\nGET toto\r\n")
+	expect(read, "$4", "PONG", "-ERR unknown command 'FOO'", "-ERR wrong number of arguments for 'GET' command", "$2", "15")
+
+	// Locks, with a deferred grant (the fencing tokens are per shard). The
+	// grant keeps the position of the LOCK command in the replies.
+	if router.shard("lk") == router.shard("other") {
+		t.Fatal("Names on the same shard")
+	}
+	send("LOCK lk\r\n")
+	expect(read, "$1", "1")
+	send2("LOCK lk 1h\r\nTRYLOCK other\r\n")
+	time.Sleep(20 * time.Millisecond)
+	send("UNLOCK lk\r\nUNLOCK lk\r\n")
+	expect(read, "+OK", "-ERR Cannot find this lock")
+	expect(read2, "$1", "2", "$1", "1")
+
+	// Same for a timeout, and a second request of a queued lock is rejected
+	send("LOCK lk 50ms\r\nLOCK lk\r\nPING\r\n")
+	expect(read, "-ERR Lock timeout", "-ERR Lock already requested", "$4", "PONG")
+
+	// Quit closes the connection
+	send("QUIT\r\n")
+	expect(read, "+OK")
+	con2.Close()
+	if _, err := bufio.NewReader(con).ReadByte(); err == nil {
+		t.Error("Connection not closed")
+	}
+}
+
+/*****************************************************************************/
+
+func TestRespShutdown(t *testing.T) {
+
+	// The shutdown error of a queued lock keeps the position of the LOCK
+	// command, before the replies of the next commands
+	router := startShards(1)
+	send, read, _ := respPipe(t, router)
+	send2, read2, _ := respPipe(t, router)
+	send("LOCK lk\r\n")
+	read()
+	read()
+	send2("SET toto 1\r\nLOCK lk\r\nGET toto\r\n")
+	if line := read2(); line != "+OK" {
+		t.Fatal("Wrong reply", line)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	w := make(waiter, 1)
+	router.shards[0].in <- &MessageQuery{oper: OP_SHUTDOWN, clt: w}
+	<-w
+	for _, l := range []string{"-ERR Server shutting down", "$1", "1"} {
+		if line := read2(); line != l {
+			t.Fatalf("Expected %q, got %q", l, line)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+func TestRespCluster(t *testing.T) {
+
+	// In cluster mode, the replies are sent once the commands are committed
+	cores, rafts := startCluster(t, 1)
+	defer rafts[0].Stop()
+	findLeader(t, cores, 0)
+	router := NewRouter(cores, DefaultOptions())
+	send, read, _ := respPipe(t, router)
+	send2, read2, _ := respPipe(t, router)
+
+	send("LOCK lk\r\n")
+	if line := read(); line != "$1" {
+		t.Fatal("Wrong reply", line)
+	}
+	read()
+	send2("SET toto 1\r\nLOCK lk\r\nINCR toto\r\nPING\r\n")
+	if line := read2(); line != "+OK" {
+		t.Fatal("Wrong reply", line)
+	}
+	time.Sleep(20 * time.Millisecond)
+	send("UNLOCK lk\r\n")
+	if line := read(); line != "+OK" {
+		t.Fatal("Wrong reply", line)
+	}
+	for _, l := range []string{"$1", "2", ":2", "$4", "PONG"} {
+		if line := read2(); line != l {
+			t.Fatalf("Expected %q, got %q", l, line)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+func TestRespMalformed(t *testing.T) {
+
+	// Invalid headers are rejected, and the connection is closed
+	router := startShards(1)
+	for _, cmd := range []string{"*-1\r\n", "*abc\r\n", "*1\r\n$-5\r\n", "*1\r\n$abc\r\n"} {
+		send, read, con := respPipe(t, router)
+		send(cmd)
+		if line := read(); line != "-ERR Protocol error" {
+			t.Errorf("Wrong reply %q to %q", line, cmd)
+		}
+		if _, err := bufio.NewReader(con).ReadByte(); err == nil {
+			t.Errorf("Connection not closed after %q", cmd)
+		}
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,309 @@
+// This file contains the Server type, which runs a lock server inside the
+// current process: the core shards, the listeners, and the optional
+// persistence, replication, cluster and monitoring services. All the
+// resources belong to the server, so that several servers can run in the
+// same process.
+
+package lockserver
+
+import "context"
+import "crypto/tls"
+import "errors"
+import "log"
+import "net"
+import "sync"
+
+/*****************************************************************************/
+
+// Server is a lock server, built from some options
+type Server struct {
+	opts        *Options     // Configuration
+	log         *log.Logger  // Logger of the server
+	mutex       sync.Mutex   // Serializes Start and Shutdown
+	router      *Router      // Core shards, nil until started
+	listeners   []*Listener  // Listeners of the clients, the main one first
+	replication net.Listener // Listener of the followers, nil if disabled
+	raft        *Raft        // Cluster node, nil if not in cluster mode
+	monitor     *Monitor     // Monitoring and HTTP gateway, nil if disabled
+	stopped     bool         // True once the server is stopped
+}
+
+/*****************************************************************************/
+
+// NewServer builds a Server object. The options must not be modified
+// afterwards.
+func NewServer(opts *Options) *Server {
+	return &Server{opts: opts, log: opts.logger()}
+}
+
+/*****************************************************************************/
+
+// check validates the options of the server
+func (opts *Options) check() error {
+
+	switch {
+	case len(opts.ClusterPeers) > 0 && (opts.Follow != "" || opts.ReplicationAddr != ""):
+		return errors.New("cluster mode is incompatible with primary/backup replication")
+	case len(opts.ClusterPeers) > 0 && opts.DataDir == "":
+		return errors.New("cluster mode needs a persistence directory for the Raft state")
+	case len(opts.ClusterPeers) > 0 && (opts.ClusterID < 0 || opts.ClusterID >= len(opts.ClusterPeers)):
+		return errors.New("invalid cluster node index")
+	case opts.Shards < 1:
+		return errors.New("invalid number of shards")
+	case opts.Shards > 1 && (opts.DataDir != "" || opts.Follow != "" || opts.ReplicationAddr != "" || len(opts.ClusterPeers) > 0):
+		return errors.New("sharding is incompatible with persistence, replication and cluster mode")
+	case opts.TLSClientCA != "" && opts.TLSCert == "":
+		return errors.New("mutual TLS needs a server certificate")
+	case opts.ChannelSize < 1 || opts.ReplyQueue < 1:
+		return errors.New("invalid channel size")
+	}
+	return nil
+}
+
+/*****************************************************************************/
+
+// Start opens the listeners, and spawns the goroutines of the server. It
+// returns once the server accepts connections. On error, everything started
+// so far is stopped.
+func (s *Server) Start() (err error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.router != nil || s.stopped {
+		return errors.New("server already started")
+	}
+	opts := s.opts
+	if err := opts.check(); err != nil {
+		return err
+	}
+
+	// Load the TLS configuration and the credentials first
+	var config *tls.Config
+	if opts.TLSCert != "" {
+		if config, err = ServerTLSConfig(opts.TLSCert, opts.TLSKey, opts.TLSClientCA); err != nil {
+			return err
+		}
+	}
+	var auth *Auth
+	if opts.AuthFile != "" {
+		if auth, err = LoadAuth(opts.AuthFile); err != nil {
+			return err
+		}
+	}
+
+	// Build the cores
+	core := NewCore(opts)
+	shards := []*Core{core}
+	for i := 1; i < opts.Shards; i++ {
+		shards = append(shards, NewCore(opts))
+	}
+	if opts.DataDir != "" && len(opts.ClusterPeers) == 0 {
+		// Load the persisted state
+		store, stats, err := OpenStore(opts.DataDir, opts.Sync)
+		if err != nil {
+			return err
+		}
+		s.log.Printf("Loaded %d values from %s\n", len(stats), opts.DataDir)
+		core.store, core.stats = store, stats
+		core.locks.SetEpoch(store.Epoch())
+	}
+	if opts.Follow != "" {
+		// Replicate the state of the primary
+		NewFollower(opts.Follow, core)
+	} else if core.store != nil {
+		// Restarting primary: a new fencing epoch is needed
+		core.nextEpoch()
+	}
+	if len(opts.ClusterPeers) > 0 {
+		// Join the cluster, with the Raft state of the previous run
+		rstore, err := OpenRaftStore(opts.DataDir)
+		if err != nil {
+			return err
+		}
+		rlis, err := net.Listen("tcp", opts.ClusterPeers[opts.ClusterID])
+		if err != nil {
+			rstore.Close()
+			return err
+		}
+		s.raft = NewRaft(opts.ClusterID, opts.ClusterPeers, opts.Addr, opts.RaftTick, core, rstore)
+		core.cluster = NewCluster(s.raft)
+		s.raft.Start(rlis)
+	}
+
+	// Start the cores: from now on, a failure stops the whole server
+	for _, shard := range shards {
+		go shard.main()
+	}
+	s.router = NewRouter(shards, opts)
+	s.router.auth = auth
+	defer func() {
+		if err != nil {
+			s.stop()
+		}
+	}()
+	if core.store != nil {
+		if opts.Sync == SYNC_PERIODIC {
+			go core.tick(opts.SyncInterval, OP_SYNC)
+		}
+		go core.tick(opts.SnapshotInterval, OP_SNAPSHOT)
+	}
+	if core.follower != nil {
+		go core.follower.follow()
+	}
+
+	// Accept the connections of the followers
+	if opts.ReplicationAddr != "" {
+		if s.replication, err = net.Listen("tcp", opts.ReplicationAddr); err != nil {
+			return err
+		}
+		go core.ServeReplication(s.replication)
+	}
+
+	// Accept the connections of the clients: main, Redis protocol, and
+	// administration listeners
+	listeners := []*Listener{{router: s.router, config: config}}
+	addrs := []string{opts.Addr}
+	if opts.RespAddr != "" {
+		listeners = append(listeners, &Listener{router: s.router, resp: true, config: config})
+		addrs = append(addrs, opts.RespAddr)
+	}
+	if opts.AdminAddr != "" {
+		listeners = append(listeners, &Listener{router: s.router, admin: true, config: config})
+		addrs = append(addrs, opts.AdminAddr)
+	}
+	for i, ln := range listeners {
+		if err = ln.Listen("tcp", addrs[i]); err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+
+	// Monitoring server and HTTP gateway
+	if opts.MonitorAddr != "" {
+		s.monitor = NewMonitor(s.router, opts.SessionTTL, config)
+		if err = s.monitor.Listen(opts.MonitorAddr); err != nil {
+			s.monitor = nil
+			return err
+		}
+	}
+	return nil
+}
+
+/*****************************************************************************/
+
+// Addr returns the address of the main listener, or nil if the server is not
+// started. It gives the actual port when the server listens to port 0.
+func (s *Server) Addr() net.Addr {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].lis.Addr()
+}
+
+/*****************************************************************************/
+
+// MonitorAddr returns the address of the monitoring server, or nil if it is
+// disabled or the server is not started
+func (s *Server) MonitorAddr() net.Addr {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.monitor == nil {
+		return nil
+	}
+	return s.monitor.lis.Addr()
+}
+
+/*****************************************************************************/
+
+// Shutdown stops the server gracefully: the listeners are closed, the clients
+// waiting for a lock get an error, the connections are closed once their
+// pending replies are written, and a final snapshot is written if persistence
+// is enabled. The connections still open when the context is done are
+// killed, and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.router == nil {
+		return errors.New("server not started")
+	}
+	if s.stopped {
+		return errors.New("server already stopped")
+	}
+
+	// Stop accepting connections
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.replication != nil {
+		s.replication.Close()
+	}
+
+	// Reject the lock intents: their clients cannot wait anymore
+	shards := s.router.shards
+	w := make(waiter, len(shards))
+	for _, core := range shards {
+		core.in <- &MessageQuery{oper: OP_SHUTDOWN, clt: w}
+	}
+	for range shards {
+		<-w
+	}
+
+	// Let the HTTP requests and the connections complete
+	if s.monitor != nil {
+		s.monitor.Shutdown(ctx)
+	}
+	s.router.drain(ctx)
+	err := ctx.Err()
+
+	// Write the final snapshot
+	for _, core := range shards {
+		if core.store != nil {
+			core.in <- &MessageQuery{oper: OP_SNAPSHOT, clt: w}
+			if r := <-w; r.Status != "OK" && err == nil {
+				err = errors.New(r.Error)
+			}
+		}
+	}
+	s.stop()
+	s.log.Println("Stopped")
+	return err
+}
+
+/*****************************************************************************/
+
+// stop releases all the resources of a started server
+func (s *Server) stop() {
+
+	s.stopped = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.replication != nil {
+		s.replication.Close()
+	}
+	if s.monitor != nil {
+		s.monitor.Close()
+	}
+	if s.raft != nil {
+		s.raft.Stop()
+	}
+
+	// Kill the remaining connections, which need the cores to be closed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.router.drain(ctx)
+
+	for _, core := range s.router.shards {
+		core.stop()
+		if core.store != nil {
+			core.store.Close()
+		}
+	}
+}
+
+/*****************************************************************************/
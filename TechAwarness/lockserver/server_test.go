@@ -0,0 +1,136 @@
+package lockserver
+
+import "bufio"
+import "context"
+import "encoding/json"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "strings"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// testServer starts a server on loopback ports chosen by the system. It is
+// stopped at the end of the test, if the test does not stop it.
+func testServer(t *testing.T, configure func(opts *Options)) *Server {
+
+	t.Helper()
+	opts := DefaultOptions()
+	opts.Addr, opts.MonitorAddr = "127.0.0.1:0", "127.0.0.1:0"
+	opts.Logger = log.New(io.Discard, "", 0)
+	if configure != nil {
+		configure(opts)
+	}
+	server := NewServer(opts)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return server
+}
+
+/*****************************************************************************/
+
+func TestServer(t *testing.T) {
+
+	// Two independent servers in the same process
+	servers := []*Server{testServer(t, nil), testServer(t, nil)}
+	for i, server := range servers {
+		con, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+		con.SetDeadline(time.Now().Add(5 * time.Second))
+		enc, dec := json.NewEncoder(con), json.NewDecoder(bufio.NewReader(con))
+		enc.Encode(&MessageQuery{Op: "incr", Target: "toto", Arg: strings.Repeat("1", i+1)})
+		m := &MessageReply{}
+		if err := dec.Decode(m); err != nil || m.Status != "OK" {
+			t.Fatal("Wrong reply", m, err)
+		}
+	}
+
+	// Each server has its own state, and its own monitoring server
+	for i, server := range servers {
+		resp, err := http.Get("http://" + server.MonitorAddr().String() + "/counters/toto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &MessageReply{}
+		json.NewDecoder(resp.Body).Decode(m)
+		resp.Body.Close()
+		if want := []string{"1", "11"}[i]; m.Value != want {
+			t.Errorf("Server %d: wrong value %q instead of %q", i, m.Value, want)
+		}
+	}
+
+	// A busy port is reported to the caller
+	opts := DefaultOptions()
+	opts.Addr, opts.MonitorAddr = servers[0].Addr().String(), ""
+	opts.Logger = log.New(io.Discard, "", 0)
+	if err := NewServer(opts).Start(); err == nil {
+		t.Error("Busy port not reported")
+	}
+	opts.Addr, opts.Shards = "127.0.0.1:0", 0
+	if err := NewServer(opts).Start(); err == nil {
+		t.Error("Invalid options not reported")
+	}
+
+	// Stopping a server does not affect the other one
+	addr := servers[0].Addr().String()
+	if err := servers[0].Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[0].Shutdown(context.Background()); err == nil {
+		t.Error("Second shutdown not reported")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Listener not closed")
+	}
+	resp, err := http.Get("http://" + servers[1].MonitorAddr().String() + "/counters/toto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Wrong status", resp.StatusCode)
+	}
+}
+
+/*****************************************************************************/
+
+func TestServerFollowerShutdown(t *testing.T) {
+
+	// The connected followers are disconnected at shutdown
+	server := testServer(t, func(opts *Options) {
+		opts.ReplicationAddr = "127.0.0.1:0"
+	})
+	con, err := net.Dial("tcp", server.replication.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(5 * time.Second))
+	dec := json.NewDecoder(bufio.NewReader(con))
+	r := &Record{}
+	if err := dec.Decode(r); err != nil || r.Op != "epoch" {
+		t.Fatal("Wrong record", r, err)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err = dec.Decode(r); err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		t.Error("Follower not disconnected", err)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,237 @@
+// This file contains the routing of the client events to the core shards.
+// Each shard is an independent core goroutine, owning the locks and the
+// values whose name hashes to it.
+
+package lockserver
+
+import "log"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+/*****************************************************************************/
+
+// Router dispatches the events of the clients to the core shards
+type Router struct {
+	shards  []*Core          // Core shards, indexed by the hash of the targets
+	ids     uint64           // Last connection id
+	auth    *Auth            // Authentication of the clients, nil if disabled
+	mutex   sync.Mutex       // Protects conns
+	conns   map[drainer]bool // Open network connections
+	log     *log.Logger      // Logger of the server
+	size    int              // Maximum number of queued replies of a connection
+	timeout time.Duration    // Write timeout of the connections, 0 to disable
+	slow    int64            // Number of clients disconnected as too slow
+	errors  int64            // Number of error replies sent to the connections
+}
+
+/*****************************************************************************/
+
+// NewRouter builds a Router object on top of some cores
+func NewRouter(shards []*Core, opts *Options) *Router {
+	return &Router{shards: shards, conns: make(map[drainer]bool), log: opts.logger(), size: opts.ReplyQueue, timeout: opts.WriteTimeout}
+}
+
+/*****************************************************************************/
+
+// nextId returns a new connection id
+func (rt *Router) nextId() uint64 {
+	return atomic.AddUint64(&rt.ids, 1)
+}
+
+/*****************************************************************************/
+
+// shard returns the index of the shard owning a name (FNV-1a hash)
+func (rt *Router) shard(name string) int {
+
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(rt.shards)))
+}
+
+/*****************************************************************************/
+
+// route sends a query to the shard of its target. A multi-lock query is
+// rejected if its targets do not belong to the same shard.
+func (rt *Router) route(m *MessageQuery) {
+
+	if len(rt.shards) == 1 {
+		rt.shards[0].in <- m
+		return
+	}
+
+	// Some queries concern all the shards: their replies are merged
+	if m.oper == OP_HELLO || m.oper == OP_LOCKS || m.oper == OP_CLIENTS || ((m.oper == OP_WATCH || m.oper == OP_UNWATCH) && m.Mode == "prefix") {
+		g := &gather{query: m, pending: len(rt.shards)}
+		for _, core := range rt.shards {
+			c := *m
+			c.seq, c.gather = 0, g
+			core.in <- &c
+		}
+		return
+	}
+
+	n := rt.shard(m.Target)
+	if len(m.Targets) > 0 {
+		n = rt.shard(m.Targets[0])
+		for _, name := range m.Targets[1:] {
+			if rt.shard(name) != n {
+				m.reply(&MessageReply{Status: "KO", Error: "Targets on several shards"})
+				return
+			}
+		}
+	}
+	rt.shards[n].in <- m
+}
+
+/*****************************************************************************/
+
+// broadcast sends a copy of an event to all the shards
+func (rt *Router) broadcast(m *MessageQuery) {
+
+	for _, core := range rt.shards {
+		c := *m
+		core.in <- &c
+	}
+}
+
+/*****************************************************************************/
+
+// deliver reads the replies sent by the shards to a connection, until all the
+// shards have closed it. The replies of the numbered queries are passed to
+// the write function in the order of the queries; the other ones (e.g.
+// deferred lock grants) are passed immediately. The flush function, if any,
+// is called when no other reply is pending, even if the last one has to wait
+// for the reply of a previous query.
+func (rt *Router) deliver(out chan *MessageReply, write func(*MessageReply), flush func()) {
+
+	closed := 0
+	next := uint64(1)
+	pending := make(map[uint64]*MessageReply)
+	for reply := range out {
+		// Check closing connection notification, from all the shards
+		if reply.oper == OP_CLOSE {
+			if closed++; closed == len(rt.shards) {
+				break
+			}
+			continue
+		}
+		if reply.seq == 0 {
+			write(reply)
+		} else {
+			// Write the replies which are now in sequence
+			pending[reply.seq] = reply
+			for r, ok := pending[next]; ok; r, ok = pending[next] {
+				delete(pending, next)
+				next++
+				if !r.skip {
+					write(r)
+				}
+			}
+		}
+		if flush != nil && len(out) == 0 {
+			flush()
+		}
+	}
+}
+
+/*****************************************************************************/
+
+// gather merges the replies of the shards to a query sent to all of them.
+// The values and infos of the OK replies are concatenated, and the clients
+// are merged; a KO reply of any shard is returned instead.
+type gather struct {
+	mutex   sync.Mutex
+	query   *MessageQuery // Original query
+	pending int           // Number of shards which have not replied yet
+	reply   *MessageReply // Merged reply
+}
+
+/*****************************************************************************/
+
+// add merges the reply of a shard, and sends the merged reply to the client
+// once all the shards have replied
+func (g *gather) add(r *MessageReply) {
+
+	g.mutex.Lock()
+	switch {
+	case g.reply == nil || (r.Status != "OK" && g.reply.Status == "OK"):
+		g.reply = r
+	case r.Status == "OK" && g.reply.Status == "OK":
+		if r.Value != "" && g.reply.Value != "" {
+			g.reply.Value += ","
+		}
+		g.reply.Value += r.Value
+		g.reply.Info = append(g.reply.Info, r.Info...)
+		g.reply.Clients = mergeClients(g.reply.Clients, r.Clients)
+	}
+	g.pending--
+	done := g.pending == 0
+	g.mutex.Unlock()
+
+	if done {
+		g.query.reply(g.reply)
+	}
+}
+
+/*****************************************************************************/
+
+// count returns the number of events processed by all the shards
+func (rt *Router) count() int64 {
+
+	var n int64
+	for _, core := range rt.shards {
+		n += atomic.LoadInt64(&core.count)
+	}
+	return n
+}
+
+/*****************************************************************************/
+
+// denials returns the number of queries denied to the clients
+func (rt *Router) denials() int64 {
+
+	if rt.auth == nil {
+		return 0
+	}
+	return rt.auth.Denials()
+}
+
+/*****************************************************************************/
+
+// deadlocks returns the number of deadlocks detected by all the shards
+func (rt *Router) deadlocks() int64 {
+
+	var n int64
+	for _, core := range rt.shards {
+		n += atomic.LoadInt64(&core.deadlocks)
+	}
+	return n
+}
+
+/*****************************************************************************/
+
+// mergeClients merges the clients listed by two shards. Each shard gives the
+// locks held on its side.
+func mergeClients(a []ClientInfo, b []ClientInfo) []ClientInfo {
+
+	pos := make(map[uint64]int)
+	for i, c := range a {
+		pos[c.Id] = i
+	}
+	for _, c := range b {
+		if i, ok := pos[c.Id]; ok {
+			a[i].Locks = append(a[i].Locks, c.Locks...)
+		} else {
+			a = append(a, c)
+		}
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Id < a[j].Id })
+	return a
+}
+
+/*****************************************************************************/
@@ -0,0 +1,136 @@
+package lockserver
+
+import "encoding/json"
+import "fmt"
+import "net"
+import "strconv"
+import "sync/atomic"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func startShards(n int) *Router {
+
+	var shards []*Core
+	for i := 0; i < n; i++ {
+		shards = append(shards, startCore())
+	}
+	return NewRouter(shards, DefaultOptions())
+}
+
+// pipeClient connects a client to the shards through an in-memory connection
+func pipeClient(t *testing.T, router *Router) (*json.Encoder, func() *MessageReply, net.Conn) {
+	return pipeConnect(t, router, false)
+}
+
+// pipeConnect connects a client, optionally with the administration rights
+func pipeConnect(t *testing.T, router *Router, admin bool) (*json.Encoder, func() *MessageReply, net.Conn) {
+
+	c1, c2 := net.Pipe()
+	clt := NewClient(c1, router)
+	clt.admin = admin
+	go clt.jsonIn()
+	go clt.jsonOut()
+	decoder := json.NewDecoder(c2)
+	next := func() *MessageReply {
+		t.Helper()
+		c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+		m := &MessageReply{}
+		if err := decoder.Decode(m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	return json.NewEncoder(c2), next, c2
+}
+
+/*****************************************************************************/
+
+func TestShardOrder(t *testing.T) {
+
+	router := startShards(4)
+	enc0, next0, con0 := pipeClient(t, router)
+	enc1, next1, con1 := pipeClient(t, router)
+
+	// Find two names owned by different shards
+	a, b := "a", "b"
+	for i := 0; router.shard(a) == router.shard(b); i++ {
+		b = "b" + strconv.Itoa(i)
+	}
+	enc0.Encode(&MessageQuery{Op: "lockall", Targets: []string{a, b}})
+	if m := next0(); m.Error != "Targets on several shards" {
+		t.Error("Wrong error", m)
+	}
+
+	// Client 0 holds locks on several shards
+	enc0.Encode(&MessageQuery{Op: "lock", Target: a})
+	next0()
+	enc0.Encode(&MessageQuery{Op: "lock", Target: b})
+	next0()
+
+	// Pipelined queries of client 1, with a queued lock in the middle
+	go func() {
+		for i := 0; i < 200; i++ {
+			q := &MessageQuery{Id: strconv.Itoa(i), Op: "incr", Target: fmt.Sprintf("k%d", i%17), Arg: "1"}
+			if i == 50 {
+				q.Op, q.Target, q.Arg = "lock", a, ""
+			}
+			enc1.Encode(q)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if i == 50 {
+			continue
+		}
+		if m := next1(); m.Id != strconv.Itoa(i) || m.Status != "OK" {
+			t.Fatalf("Expected reply %d, got %+v", i, m)
+		}
+	}
+
+	// Closing client 0 releases its locks on all the shards
+	con0.Close()
+	if m := next1(); m.Id != "50" || m.Status != "OK" {
+		t.Error("Lock not granted", m)
+	}
+	enc1.Encode(&MessageQuery{Op: "trylock", Target: b})
+	if m := next1(); m.Status != "OK" {
+		t.Error("Lock not released", m)
+	}
+	con1.Close()
+}
+
+/*****************************************************************************/
+
+// BenchmarkShards measures the throughput of incr operations, issued by
+// parallel pipelined clients, depending on the number of shards
+func BenchmarkShards(b *testing.B) {
+
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards-%d", n), func(b *testing.B) {
+			router := startShards(n)
+			var id int64
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				r := &replier{out: make(chan *MessageReply, 64)}
+				router.broadcast(&MessageQuery{clt: r, oper: OP_OPEN})
+				prefix := strconv.FormatInt(atomic.AddInt64(&id, 1), 10) + "."
+				pending, i := 0, 0
+				for pb.Next() {
+					i++
+					router.route(&MessageQuery{Op: "incr", Target: prefix + strconv.Itoa(i%64), Arg: "1", oper: OP_INCR, clt: r})
+					if pending++; pending == 32 {
+						for ; pending > 0; pending-- {
+							<-r.out
+						}
+					}
+				}
+				for ; pending > 0; pending-- {
+					<-r.out
+				}
+			})
+		})
+	}
+}
+
+/*****************************************************************************/
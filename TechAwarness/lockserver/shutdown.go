@@ -0,0 +1,112 @@
+// This file contains the graceful shutdown of the server. The listeners stop
+// accepting connections, the clients waiting for a lock get an error, the
+// connections are closed once their pending replies are written, and a final
+// snapshot is written if persistence is enabled.
+
+package lockserver
+
+import "context"
+import "time"
+
+/*****************************************************************************/
+
+// drainer is implemented by the network connections, which are closed
+// gracefully at shutdown
+type drainer interface {
+	Drain() // Stops reading the queries: the connection is closed once the replies are written
+	Kill()  // Closes the connection immediately
+}
+
+/*****************************************************************************/
+
+// waiter receives the replies of the internal queries of the shutdown
+type waiter chan *MessageReply
+
+// Reply is used by the core methods to return a reply to the shutdown
+func (w waiter) Reply(r *MessageReply) {
+	w <- r
+}
+
+/*****************************************************************************/
+
+// track registers an open connection, until it is closed with untrack
+func (rt *Router) track(conn drainer) {
+
+	rt.mutex.Lock()
+	rt.conns[conn] = true
+	rt.mutex.Unlock()
+}
+
+/*****************************************************************************/
+
+// untrack unregisters a closed connection
+func (rt *Router) untrack(conn drainer) {
+
+	rt.mutex.Lock()
+	delete(rt.conns, conn)
+	rt.mutex.Unlock()
+}
+
+/*****************************************************************************/
+
+// drain closes all the connections once their pending replies are written.
+// The connections which are still open when the context is done are killed.
+func (rt *Router) drain(ctx context.Context) {
+
+	for {
+		rt.mutex.Lock()
+		n := len(rt.conns)
+		late := ctx.Err() != nil
+		for conn := range rt.conns {
+			if late {
+				conn.Kill()
+			} else {
+				conn.Drain()
+			}
+		}
+		rt.mutex.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*****************************************************************************/
+
+// handleShutdown rejects the lock intents which are not granted: the clients
+// get a shutdown error, and the new lock requests are rejected. In cluster
+// mode, the intents are only removed from the replicated state when the
+// connections are closed.
+func (core *Core) handleShutdown(query *MessageQuery) {
+
+	core.stopping = true
+	var granted []*Intent
+	for _, clt := range core.locks.Clients() {
+		for _, it := range core.locks.Intents(clt) {
+			if it.held() {
+				continue
+			}
+			id := it.id
+			if g := it.group; g != nil {
+				// A multi-lock request is rejected once
+				if it != g.intents[0] {
+					continue
+				}
+				id = g.id
+				if core.cluster == nil {
+					res, _ := core.locks.CancelGroup(g)
+					granted = append(granted, res...)
+				}
+			} else if core.cluster == nil {
+				res, _ := core.locks.Cancel(it)
+				granted = append(granted, res...)
+			}
+			clt.Reply(&MessageReply{Id: id, Status: "KO", Error: "Server shutting down", seq: it.reply})
+		}
+	}
+	core.grant(granted)
+	query.clt.Reply(&MessageReply{Status: "OK"})
+}
+
+/*****************************************************************************/
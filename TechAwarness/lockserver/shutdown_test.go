@@ -0,0 +1,84 @@
+package lockserver
+
+import "bufio"
+import "context"
+import "encoding/json"
+import "net"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func TestShutdown(t *testing.T) {
+
+	// Single shard with persistence
+	dir := t.TempDir()
+	server := testServer(t, func(opts *Options) {
+		opts.DataDir, opts.Sync = dir, SYNC_NEVER
+	})
+	addr := server.Addr().String()
+
+	// connect opens a connection, and returns its encoder and decoder
+	connect := func() (*json.Encoder, *json.Decoder, net.Conn) {
+		t.Helper()
+		con, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		con.SetDeadline(time.Now().Add(5 * time.Second))
+		return json.NewEncoder(con), json.NewDecoder(bufio.NewReader(con)), con
+	}
+	enc0, dec0, con0 := connect()
+	defer con0.Close()
+	enc1, dec1, con1 := connect()
+	defer con1.Close()
+
+	m := &MessageReply{}
+	enc0.Encode(&MessageQuery{Op: "lock", Target: "toto"})
+	enc0.Encode(&MessageQuery{Op: "incr", Target: "titi", Arg: "5"})
+	for i := 0; i < 2; i++ {
+		if err := dec0.Decode(m); err != nil || m.Status != "OK" {
+			t.Fatal("Wrong reply", m, err)
+		}
+	}
+	enc1.Encode(&MessageQuery{Id: "w", Op: "lock", Target: "toto"})
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Error("Shutdown failed", err)
+		}
+		done <- true
+	}()
+
+	// The waiting client gets an error, then both connections are closed
+	if err := dec1.Decode(m); err != nil || m.Id != "w" || m.Error != "Server shutting down" {
+		t.Error("Wrong reply", m, err)
+	}
+	if err := dec1.Decode(m); err == nil {
+		t.Error("Connection not closed", m)
+	}
+	if err := dec0.Decode(m); err == nil {
+		t.Error("Connection not closed", m)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown not completed")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Listener not closed")
+	}
+
+	// The final snapshot has been written
+	if fi, err := os.Stat(filepath.Join(dir, "stats.snap")); err != nil || fi.Size() == 0 {
+		t.Error("No final snapshot", err)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,86 @@
+// This file contains the protection against the slow consumers. The cores
+// never block on a connection: the replies are queued in a bounded channel,
+// and a connection whose queue is full, or whose socket cannot be written
+// within the write timeout, is disconnected. Its locks are then released like
+// for any other closed connection.
+
+package lockserver
+
+import "errors"
+import "net"
+import "os"
+import "sync/atomic"
+import "time"
+
+/*****************************************************************************/
+
+// newQueue builds the reply channel of a connection. On top of the queued
+// replies, some room is reserved for the close notifications of the shards,
+// and for the replies racing with the overflow check.
+func (rt *Router) newQueue() chan *MessageReply {
+	return make(chan *MessageReply, rt.size+2*len(rt.shards)+1)
+}
+
+/*****************************************************************************/
+
+// push queues a reply for a connection, without blocking. The connection is
+// disconnected if its queue is full, and the next replies are dropped.
+func (rt *Router) push(conn Connection, out chan *MessageReply, slow *int32, r *MessageReply) {
+
+	if r.Status == "KO" {
+		atomic.AddInt64(&rt.errors, 1)
+	}
+
+	// The close notifications end the writing goroutine: they are never dropped
+	if r.oper == OP_CLOSE {
+		out <- r
+		return
+	}
+	if atomic.LoadInt32(slow) == 0 && len(out) < rt.size {
+		select {
+		case out <- r:
+			return
+		default:
+		}
+	}
+	if atomic.CompareAndSwapInt32(slow, 0, 1) {
+		rt.log.Println("Slow client, disconnecting", describe(conn))
+		atomic.AddInt64(&rt.slow, 1)
+		go conn.Kill()
+	}
+}
+
+/*****************************************************************************/
+
+// deadline sets the write deadline of a connection, before a reply is written
+func (rt *Router) deadline(con net.Conn) {
+
+	if rt.timeout > 0 {
+		con.SetWriteDeadline(time.Now().Add(rt.timeout))
+	}
+}
+
+/*****************************************************************************/
+
+// writeFailed handles a write error on a connection. The connection is
+// closed, so that the reading goroutine notifies the shards; a write timeout
+// is counted as a slow client.
+func (rt *Router) writeFailed(conn Connection, slow *int32, err error) {
+
+	if errors.Is(err, os.ErrDeadlineExceeded) && atomic.CompareAndSwapInt32(slow, 0, 1) {
+		rt.log.Println("Slow client, disconnecting", describe(conn))
+		atomic.AddInt64(&rt.slow, 1)
+	} else if atomic.LoadInt32(slow) == 0 {
+		rt.log.Println("Error ", err)
+	}
+	conn.Kill()
+}
+
+/*****************************************************************************/
+
+// slowClients returns the number of clients disconnected as too slow
+func (rt *Router) slowClients() int64 {
+	return atomic.LoadInt64(&rt.slow)
+}
+
+/*****************************************************************************/
@@ -0,0 +1,73 @@
+package lockserver
+
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// expectRelease checks that a lock held by a slow client is released
+func expectRelease(t *testing.T, router *Router) {
+
+	t.Helper()
+	enc, next, con := pipeClient(t, router)
+	defer con.Close()
+	enc.Encode(&MessageQuery{Op: "lock", Target: "toto", Arg: "2s"})
+	if m := next(); m.Status != "OK" {
+		t.Error("Lock not released", m)
+	}
+	if n := router.slowClients(); n != 1 {
+		t.Error("Wrong number of slow clients", n)
+	}
+}
+
+/*****************************************************************************/
+
+func TestSlowQueue(t *testing.T) {
+
+	opts := DefaultOptions()
+	opts.ReplyQueue = 4
+	router := NewRouter([]*Core{startCore()}, opts)
+
+	// The client holds a lock, then stops reading its replies
+	enc, next, con := pipeClient(t, router)
+	defer con.Close()
+	enc.Encode(&MessageQuery{Op: "lock", Target: "toto"})
+	next()
+	for i := 0; i < 1000; i++ {
+		if err := enc.Encode(&MessageQuery{Op: "get", Target: "titi"}); err != nil {
+			break
+		}
+	}
+	expectRelease(t, router)
+}
+
+/*****************************************************************************/
+
+func TestSlowWrite(t *testing.T) {
+
+	opts := DefaultOptions()
+	opts.WriteTimeout = 50 * time.Millisecond
+	router := NewRouter([]*Core{startCore()}, opts)
+
+	// The client does not read the reply of its lock
+	enc, _, con := pipeClient(t, router)
+	defer con.Close()
+	enc.Encode(&MessageQuery{Op: "lock", Target: "toto"})
+
+	// Wait until the lock is held, before another client requests it
+	enc2, next2, con2 := pipeClient(t, router)
+	defer con2.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		enc2.Encode(&MessageQuery{Op: "owner", Target: "toto"})
+		if m := next2(); len(m.Info) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Lock not granted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expectRelease(t, router)
+}
+
+/*****************************************************************************/
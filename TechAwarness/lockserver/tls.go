@@ -0,0 +1,102 @@
+// This file contains the TLS configuration of the server and of the clients.
+// With mutual TLS, the verified client certificates identify the users: the
+// common name of the certificate is taken as the user name, so that the
+// client does not need the auth operation.
+
+package lockserver
+
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "net"
+import "os"
+
+/*****************************************************************************/
+
+// ServerTLSConfig builds the TLS configuration of the server from its
+// certificate and key files. If a CA file is given, the clients must present
+// a certificate signed by this CA (mutual TLS).
+func ServerTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs, config.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/*****************************************************************************/
+
+// ClientTLSConfig builds the TLS configuration of a client. The server is
+// verified with the CA file if given, or the system roots otherwise. The
+// optional certificate and key files give the client certificate.
+func ClientTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+/*****************************************************************************/
+
+// loadPool reads a PEM file of CA certificates
+func loadPool(caFile string) (*x509.CertPool, error) {
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(caFile + ": no certificate found")
+	}
+	return pool, nil
+}
+
+/*****************************************************************************/
+
+// certUser returns the user named by the verified client certificate of a
+// connection, or nil. The TLS handshake is completed first.
+func certUser(con net.Conn, auth *Auth) *User {
+
+	tc, ok := con.(*tls.Conn)
+	if !ok || tc.Handshake() != nil {
+		return nil
+	}
+	return auth.certUser(tc.ConnectionState())
+}
+
+/*****************************************************************************/
+
+// certUser returns the user named by the verified client certificate of a
+// TLS connection state, or nil
+func (a *Auth) certUser(state tls.ConnectionState) *User {
+
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return a.users[state.VerifiedChains[0][0].Subject.CommonName]
+}
+
+/*****************************************************************************/
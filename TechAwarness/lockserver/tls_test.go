@@ -0,0 +1,157 @@
+package lockserver
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/json"
+import "encoding/pem"
+import "math/big"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+// writeCert generates a certificate signed by a parent (self-signed if nil),
+// and writes it with its key in a directory. It returns the certificate and
+// its key.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// testCerts generates a CA, a server certificate, and the client certificates
+// of the stats user and of an unknown user
+func testCerts(t *testing.T) string {
+
+	dir := t.TempDir()
+	ca, key := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, key)
+	writeCert(t, dir, "stats", ca, key)
+	writeCert(t, dir, "nobody", ca, key)
+	return dir
+}
+
+/*****************************************************************************/
+
+func TestTLS(t *testing.T) {
+
+	dir := testCerts(t)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	config, err := ServerTLSConfig(file("server.pem"), file("server.key"), file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	router := startShards(1)
+	router.auth = testAuth(t)
+	go (&Listener{router: router, config: config}).Serve(lis)
+
+	// query connects with a client certificate, and sends a query
+	query := func(cert string, m *MessageQuery) (*MessageReply, error) {
+		t.Helper()
+		config, err := ClientTLSConfig(file("ca.pem"), file(cert+".pem"), file(cert+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		con, err := tls.Dial("tcp", lis.Addr().String(), config)
+		if err != nil {
+			return nil, err
+		}
+		defer con.Close()
+		con.SetDeadline(time.Now().Add(2 * time.Second))
+		json.NewEncoder(con).Encode(m)
+		reply := &MessageReply{}
+		return reply, json.NewDecoder(con).Decode(reply)
+	}
+
+	// The certificate identifies the user
+	if r, err := query("stats", &MessageQuery{Op: "get", Target: "stats.cpu"}); err != nil || r.Status != "OK" {
+		t.Error("Query rejected", r, err)
+	}
+	if r, err := query("stats", &MessageQuery{Op: "set", Target: "stats.cpu", Arg: "1"}); err != nil || r.Error != "Permission denied" {
+		t.Error("Query accepted", r, err)
+	}
+	if r, err := query("nobody", &MessageQuery{Op: "get", Target: "stats.cpu"}); err != nil || r.Error != "Authentication required" {
+		t.Error("Unknown user accepted", r, err)
+	}
+
+	// A client certificate is required
+	config, _ = ClientTLSConfig(file("ca.pem"), "", "")
+	if con, err := tls.Dial("tcp", lis.Addr().String(), config); err == nil {
+		con.SetDeadline(time.Now().Add(2 * time.Second))
+		json.NewEncoder(con).Encode(&MessageQuery{Op: "get", Target: "stats.cpu"})
+		if _, err := con.Read(make([]byte, 1)); err == nil {
+			t.Error("Client without certificate accepted")
+		}
+		con.Close()
+	}
+}
+
+/*****************************************************************************/
+
+func TestGatewayTLS(t *testing.T) {
+
+	dir := testCerts(t)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	router := startShards(1)
+	router.auth = testAuth(t)
+	mux := http.NewServeMux()
+	NewGateway(router, time.Hour).register(mux)
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS, _ = ServerTLSConfig(file("server.pem"), file("server.key"), file("ca.pem"))
+	server.StartTLS()
+	defer server.Close()
+
+	config, err := ClientTLSConfig(file("ca.pem"), file("stats.pem"), file("stats.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(server.URL + "/counters/stats.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Wrong status", resp.StatusCode)
+	}
+}
+
+/*****************************************************************************/
@@ -0,0 +1,192 @@
+// This file contains the subscriptions to the changes of the integer values.
+// A client can watch a name, or all the names starting with a prefix: each
+// set or incr operation on a watched name is then notified to the client.
+
+package lockserver
+
+import "strconv"
+
+/*****************************************************************************/
+
+// watch identifies a subscription of a client
+type watch struct {
+	name   string // Watched name, or prefix
+	prefix bool   // True for a prefix subscription
+}
+
+/*****************************************************************************/
+
+// WatchArea is the subscription management data structure
+type WatchArea struct {
+	exact   map[string]map[Replier]bool // Subscribers, by name
+	prefix  map[string]map[Replier]bool // Subscribers, by prefix
+	clients map[Replier]map[watch]bool  // Subscriptions, by client
+}
+
+/*****************************************************************************/
+
+// NewWatchArea builds a WatchArea object
+func NewWatchArea() *WatchArea {
+	return &WatchArea{
+		exact:   make(map[string]map[Replier]bool),
+		prefix:  make(map[string]map[Replier]bool),
+		clients: make(map[Replier]map[watch]bool),
+	}
+}
+
+/*****************************************************************************/
+
+// table returns the subscribers map matching the kind of subscription
+func (wa *WatchArea) table(prefix bool) map[string]map[Replier]bool {
+
+	if prefix {
+		return wa.prefix
+	}
+	return wa.exact
+}
+
+/*****************************************************************************/
+
+// Watch subscribes a client to a name or a prefix
+func (wa *WatchArea) Watch(clt Replier, name string, prefix bool) {
+
+	table := wa.table(prefix)
+	if table[name] == nil {
+		table[name] = make(map[Replier]bool)
+	}
+	table[name][clt] = true
+	if wa.clients[clt] == nil {
+		wa.clients[clt] = make(map[watch]bool)
+	}
+	wa.clients[clt][watch{name, prefix}] = true
+}
+
+/*****************************************************************************/
+
+// Unwatch cancels a subscription. It returns false if the subscription does
+// not exist.
+func (wa *WatchArea) Unwatch(clt Replier, name string, prefix bool) bool {
+
+	w := watch{name, prefix}
+	if !wa.clients[clt][w] {
+		return false
+	}
+	delete(wa.clients[clt], w)
+	if len(wa.clients[clt]) == 0 {
+		delete(wa.clients, clt)
+	}
+	table := wa.table(prefix)
+	delete(table[name], clt)
+	if len(table[name]) == 0 {
+		delete(table, name)
+	}
+	return true
+}
+
+/*****************************************************************************/
+
+// Watchers returns the clients subscribed to a name, directly or through a
+// prefix. Each client is returned once.
+func (wa *WatchArea) Watchers(name string) []Replier {
+
+	var res []Replier
+	seen := make(map[Replier]bool)
+	add := func(subscribers map[Replier]bool) {
+		for clt := range subscribers {
+			if !seen[clt] {
+				seen[clt] = true
+				res = append(res, clt)
+			}
+		}
+	}
+	add(wa.exact[name])
+	if len(wa.prefix) > 0 {
+		for i := 0; i <= len(name); i++ {
+			add(wa.prefix[name[:i]])
+		}
+	}
+	return res
+}
+
+/*****************************************************************************/
+
+// RemoveClient cancels all the subscriptions of a client
+func (wa *WatchArea) RemoveClient(clt Replier) {
+
+	for w := range wa.clients[clt] {
+		wa.Unwatch(clt, w.name, w.prefix)
+	}
+}
+
+/*****************************************************************************/
+
+// handleWatch subscribes a client to the changes of a value, or of all the
+// values whose name starts with the target in the "prefix" mode. The current
+// value is returned for a single value.
+func (core *Core) handleWatch(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Watching", query.Target, query.Mode)
+	}
+	prefix, ok := parseWatchMode(query.Mode)
+	if !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid watch mode"})
+		return
+	}
+	core.watches.Watch(query.clt, query.Target, prefix)
+	reply := &MessageReply{Status: "OK"}
+	if !prefix {
+		reply.Value = strconv.FormatInt(core.stats[query.Target], 10)
+	}
+	query.reply(reply)
+}
+
+/*****************************************************************************/
+
+// handleUnwatch cancels a subscription
+func (core *Core) handleUnwatch(query *MessageQuery) {
+
+	if core.verbose {
+		core.log.Println("Unwatching", query.Target, query.Mode)
+	}
+	prefix, ok := parseWatchMode(query.Mode)
+	if !ok {
+		query.reply(&MessageReply{Status: "KO", Error: "Invalid watch mode"})
+	} else if core.watches.Unwatch(query.clt, query.Target, prefix) {
+		query.reply(&MessageReply{Status: "OK"})
+	} else {
+		query.reply(&MessageReply{Status: "KO", Error: "Cannot find this watch"})
+	}
+}
+
+/*****************************************************************************/
+
+// publish notifies the new value of a name to its subscribers. The
+// notifications are marked with the "change" event, and carry the name.
+func (core *Core) publish(name string) {
+
+	watchers := core.watches.Watchers(name)
+	if len(watchers) == 0 {
+		return
+	}
+	value := strconv.FormatInt(core.stats[name], 10)
+	for _, clt := range watchers {
+		clt.Reply(&MessageReply{Status: "OK", Event: "change", Target: name, Value: value})
+	}
+}
+
+/*****************************************************************************/
+
+// parseWatchMode converts a watch mode into a prefix flag
+func parseWatchMode(mode string) (prefix bool, ok bool) {
+
+	switch mode {
+	case "":
+		return false, true
+	case "prefix":
+		return true, true
+	}
+	return false, false
+}
+
+/*****************************************************************************/
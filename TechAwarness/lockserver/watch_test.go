@@ -0,0 +1,114 @@
+package lockserver
+
+import "testing"
+import "time"
+
+/*****************************************************************************/
+
+func TestWatchArea(t *testing.T) {
+
+	wa := NewWatchArea()
+	c := []Replier{&clt{n: 0}, &clt{n: 1}}
+	wa.Watch(c[0], "toto", false)
+	wa.Watch(c[0], "to", true)
+	wa.Watch(c[1], "t", true)
+	wa.Watch(c[1], "", true)
+
+	if w := wa.Watchers("toto"); len(w) != 2 {
+		t.Error("Wrong watchers", w)
+	}
+	if w := wa.Watchers("tutu"); len(w) != 1 || w[0] != c[1] {
+		t.Error("Wrong watchers", w)
+	}
+	if wa.Unwatch(c[0], "toto", true) || !wa.Unwatch(c[0], "toto", false) {
+		t.Error("Wrong unwatch")
+	}
+	if w := wa.Watchers("toto"); len(w) != 2 {
+		t.Error("Wrong watchers", w)
+	}
+
+	wa.RemoveClient(c[0])
+	wa.RemoveClient(c[1])
+	if len(wa.exact) != 0 || len(wa.prefix) != 0 || len(wa.clients) != 0 {
+		t.Error("Subscriptions not cleaned up", wa)
+	}
+}
+
+/*****************************************************************************/
+
+func TestWatch(t *testing.T) {
+
+	core := startCore()
+	c0, c1 := newReplier(core), newReplier(core)
+
+	c0.send("set", "toto", "10")
+	c0.expect(t, "OK")
+	c1.send("watch", "toto", "")
+	if m := c1.expect(t, "OK"); m.Value != "10" || m.Event != "" {
+		t.Error("Wrong watch reply", m)
+	}
+	c1.sendMode("watch", "ti", "prefix")
+	c1.expect(t, "OK")
+
+	// Changes are notified, once per client
+	c0.send("incr", "toto", "5")
+	c0.expect(t, "OK")
+	if m := c1.expect(t, "OK"); m.Event != "change" || m.Target != "toto" || m.Value != "15" {
+		t.Error("Wrong notification", m)
+	}
+	c0.send("set", "titi", "1")
+	c0.expect(t, "OK")
+	if m := c1.expect(t, "OK"); m.Target != "titi" || m.Value != "1" {
+		t.Error("Wrong notification", m)
+	}
+	c0.send("set", "tutu", "1")
+	c0.expect(t, "OK")
+	c0.send("set", "toto", "x")
+	c0.expect(t, "KO")
+	c1.silent(t, 20*time.Millisecond)
+
+	c1.send("unwatch", "toto", "")
+	c1.expect(t, "OK")
+	c1.send("unwatch", "toto", "")
+	if m := c1.expect(t, "KO"); m.Error != "Cannot find this watch" {
+		t.Error("Wrong error", m.Error)
+	}
+
+	// Subscriptions are cleaned up when the client leaves
+	c1.close()
+	c0.send("set", "titi", "2")
+	c0.expect(t, "OK")
+	c0.send("get", "titi", "")
+	c0.expect(t, "OK")
+	if len(core.watches.clients) != 0 {
+		t.Error("Subscriptions not cleaned up")
+	}
+}
+
+/*****************************************************************************/
+
+func TestWatchShards(t *testing.T) {
+
+	router := startShards(4)
+	r := &replier{out: make(chan *MessageReply, 64)}
+	router.broadcast(&MessageQuery{clt: r, oper: OP_OPEN})
+
+	// A prefix subscription covers all the shards, with a single reply
+	router.route(&MessageQuery{Op: "watch", Target: "k", Mode: "prefix", oper: OP_WATCH, clt: r})
+	r.expect(t, "OK")
+	for _, name := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		router.route(&MessageQuery{Op: "set", Target: name, Arg: "1", oper: OP_SET, clt: r})
+	}
+	notified := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		if m := r.expect(t, "OK"); m.Event == "change" {
+			notified[m.Target] = true
+		}
+	}
+	if len(notified) != 5 {
+		t.Error("Missing notifications", notified)
+	}
+	r.silent(t, 20*time.Millisecond)
+}
+
+/*****************************************************************************/